@@ -1,24 +1,46 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"vk/internal/config"
 	"vk/internal/queue"
+	"vk/internal/retry"
+	"vk/internal/worker"
 	"vk/pkg/repository"
 	processor "vk/pkg/service"
+	"vk/pkg/urlnorm"
+	"vk/pkg/validator"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"go.etcd.io/bbolt"
 )
 
+// errResultLost stops the service once a result is lost, as offsets can't be
+// committed past it anymore.
+var errResultLost = errors.New("result lost")
+
 func main() {
+	// exitCode is set when the service stops on an error, the deferred calls
+	// still run before the exit
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	// configure
 	err := godotenv.Load()
 	if err != nil {
@@ -31,85 +53,293 @@ func main() {
 	}
 
 	// producer
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+	producerConfig := &kafka.ConfigMap{
 		"bootstrap.servers": fmt.Sprintf("%s:%s", cfg.KafkaBrokerHost, cfg.KafkaBrokerPort),
-	})
+		"partitioner":       cfg.KafkaPartitioner,
+		"linger.ms":         int(cfg.KafkaProducerLinger.Milliseconds()),
+		"batch.size":        cfg.KafkaProducerBatchSize,
+		"compression.type":  cfg.KafkaProducerCompression,
+	}
+	if cfg.KafkaExactlyOnce {
+		producerConfig.SetKey("transactional.id", cfg.KafkaTransactionalID)
+	}
+
+	producer, err := kafka.NewProducer(producerConfig)
 	if err != nil {
 		panic(err)
 	}
 	defer producer.Close()
 
-	qw := queue.NewKafkaQueueWriter(cfg.KafkaOutTopic, producer)
+	// codecs of message values by topic
+	var registry queue.SchemaRegistry
+	if cfg.SchemaRegistryPath != "" {
+		registry, err = queue.NewFileRegistry(cfg.SchemaRegistryPath)
+		if err != nil {
+			log.Fatalf("Error loading schema registry: %v", err)
+		}
+	}
+
+	codecs, err := queue.ParseCodecs(cfg.KafkaCodec, cfg.KafkaTopicCodecs, registry)
+	if err != nil {
+		log.Fatalf("Error parsing codecs: %v", err)
+	}
+
+	writerOpts := []queue.WriterOption{queue.WithWriterCodec(codecs)}
+	consumerOpts := []queue.ConsumerOption{queue.WithCommitInterval(cfg.KafkaCommitInterval)}
+	if cfg.KafkaExactlyOnce {
+		consumerOpts = append(consumerOpts, queue.WithTransactionalOffsets())
+	}
+
+	retryPolicy := retry.Policy{
+		MaxAttempts:    cfg.RetryMaxAttempts,
+		InitialBackoff: cfg.RetryInitialBackoff,
+		MaxBackoff:     cfg.RetryMaxBackoff,
+		Multiplier:     retry.DefaultPolicy.Multiplier,
+		Jitter:         retry.DefaultPolicy.Jitter,
+	}
+
+	var deadLetters *queue.KafkaDeadLetterWriter
+	if cfg.KafkaDLQTopic != "" {
+		deadLetters = queue.NewKafkaDeadLetterWriter(cfg.KafkaDLQTopic, producer)
+	}
+
+	// results are enqueued without waiting for delivery and flushed before
+	// offsets are committed; transactions of the exactly-once mode are
+	// flushed on commit anyway
+	var async *queue.KafkaAsyncProducer
+	if cfg.KafkaProducerAsync && !cfg.KafkaExactlyOnce {
+		async = queue.NewKafkaAsyncProducer(producer,
+			queue.WithDeliveryRetry(retryPolicy),
+			// failed results are handled like the ones written synchronously;
+			// if the dead letter fails too, offsets are not committed anymore
+			queue.WithDeliveryErrorHandler(func(msg *kafka.Message, err error) error {
+				if deadLetters == nil {
+					log.Printf("Skipping result %v at %s stage: %v", msg.TopicPartition, stageWrite, err)
+					return nil
+				}
+
+				log.Printf("Dead-lettering result %v at %s stage: %v", msg.TopicPartition, stageWrite, err)
+				return deadLetters.WriteDeadLetter(context.Background(), msg, stageWrite, err)
+			}),
+		)
+		writerOpts = append(writerOpts, queue.WithAsyncProducer(async))
+		consumerOpts = append(consumerOpts, queue.WithBeforeCommit(func() error {
+			return flushProducer(async, cfg.KafkaProducerFlushTimeout)
+		}))
+	}
+
+	qw := queue.NewKafkaQueueWriter(cfg.KafkaOutTopic, producer, writerOpts...)
 
 	// consumer
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+	consumer, err := queue.NewKafkaConsumer(&kafka.ConfigMap{
 		"bootstrap.servers": fmt.Sprintf("%s:%s", cfg.KafkaBrokerHost, cfg.KafkaBrokerPort),
 		"group.id":          "consumer-group",
 		"auto.offset.reset": "earliest",
-	})
+	}, cfg.KafkaInTopic, consumerOpts...)
 	if err != nil {
 		panic(err)
 	}
 	defer consumer.Close()
 
-	consumer.Subscribe(cfg.KafkaInTopic, nil)
-
-	qr := queue.NewKafkaQueueReader()
+	qr := queue.NewKafkaQueueReader(queue.WithReaderCodec(codecs))
 
 	// repo
-	dsn := "user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword +
-		" dbname=" + cfg.PostgresDB + " sslmode=disable" +
-		" host=" + cfg.PostgresHost + " port=" + cfg.PostgresPort
+	var repo repository.Repository
+	repoOpts := []repository.Option{repository.WithLockTimeout(cfg.LockTimeout)}
 
-	db, err := sqlx.Connect("postgres", dsn)
-	if err != nil {
-		log.Fatalln(err)
+	switch cfg.RepositoryType {
+	case config.RepositoryPostgres:
+		dsn := "user=" + cfg.PostgresUser + " password=" + cfg.PostgresPassword +
+			" dbname=" + cfg.PostgresDB + " sslmode=disable" +
+			" host=" + cfg.PostgresHost + " port=" + cfg.PostgresPort
+
+		db, err := sqlx.Connect("postgres", dsn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		repo = repository.NewPostgresRepository(db, repoOpts...)
+	case config.RepositoryMemory:
+		if cfg.MemoryDataDir == "" {
+			repo = repository.NewInMemoryRepository(repoOpts...)
+			break
+		}
+
+		memoryRepo, err := repository.OpenInMemoryRepository(cfg.MemoryDataDir, cfg.MemorySnapshotInterval, repoOpts...)
+		if err != nil {
+			log.Fatalf("Error restoring repository: %v", err)
+		}
+		defer memoryRepo.Close()
+		repo = memoryRepo
+	case config.RepositoryShardedMemory:
+		repo = repository.NewShardedInMemoryRepository(cfg.MemoryShardCount, repoOpts...)
+	case config.RepositoryBolt:
+		db, err := bbolt.Open(cfg.BoltPath, 0o600, &bbolt.Options{Timeout: time.Second})
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", cfg.BoltPath, err)
+		}
+		defer db.Close()
+
+		repo, err = repository.NewBoltRepository(db, repoOpts...)
+		if err != nil {
+			log.Fatalf("Error creating repository: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown repository type: %s", cfg.RepositoryType)
 	}
-	repo := repository.NewPostgresRepository(db)
 
 	// processor
-	p := processor.NewProcessor(repo)
+	var opts []processor.Option
+	switch cfg.ProcessorMode {
+	case config.ProcessorModeLock:
+	case config.ProcessorModeOptimistic:
+		opts = append(opts, processor.WithOptimisticLocking(cfg.ProcessorMaxRetries))
+	default:
+		log.Fatalf("Unknown processor mode: %s", cfg.ProcessorMode)
+	}
 
-	// logic
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	merge, err := processor.MergeStrategyByName(cfg.MergeStrategy)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if cfg.MergeFieldRules != "" {
+		merge, err = processor.ParseFieldRules(cfg.MergeFieldRules)
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	opts = append(opts, processor.WithMergeStrategy(merge))
 
-	run := true
+	var normalizer *urlnorm.Normalizer
+	if cfg.URLNormalize {
+		normalizerOpts := []urlnorm.Option{urlnorm.WithScheme(cfg.URLScheme)}
+		if cfg.URLTrackingParams != "" {
+			normalizerOpts = append(normalizerOpts, urlnorm.WithTrackingParams(strings.Split(cfg.URLTrackingParams, ",")...))
+		}
+		normalizer = urlnorm.New(normalizerOpts...)
+		opts = append(opts, processor.WithURLNormalizer(normalizer))
+	}
 
-	for run {
-		select {
-		case sig := <-sigchan:
-			log.Printf("Caught signal %v: terminating\n", sig)
-			run = false
+	// validator
+	var rules []validator.Rule
+	for _, name := range strings.Split(cfg.ValidationRules, ",") {
+		switch name {
+		case "":
+		case config.ValidationRuleURL:
+			rules = append(rules, validator.RequireURL)
+		case config.ValidationRuleFetchTime:
+			rules = append(rules, validator.RequireFetchTime)
+		case config.ValidationRuleFutureFetchTime:
+			rules = append(rules, validator.MaxFetchTime(time.Now, cfg.ValidationMaxClockSkew))
+		case config.ValidationRuleTextSize:
+			rules = append(rules, validator.MaxTextSize(cfg.ValidationMaxTextSize))
 		default:
-			msg, err := consumer.ReadMessage(-1)
-			if err == nil {
-				_ = processMessage(msg.Value, qr, qw, p)
-			} else {
-				log.Fatalf("Consumer error: %v (%v)\n", err, msg)
+			log.Fatalf("Unknown validation rule: %s", name)
+		}
+	}
+
+	pipe := &pipeline{
+		reader:     qr,
+		normalizer: normalizer,
+		validator:  validator.New(rules...),
+		processor:  processor.NewProcessor(repo, opts...),
+		retry:      retryPolicy,
+		writer:     qw,
+	}
+	// optional writers are set only when configured, so that the interfaces
+	// stay nil otherwise; documents that did not change are dropped unless
+	// they have their own topic
+	if cfg.KafkaNoopTopic != "" {
+		pipe.noopWriter = queue.NewKafkaQueueWriter(cfg.KafkaNoopTopic, producer, writerOpts...)
+	}
+	if cfg.KafkaChangesTopic != "" {
+		pipe.changesWriter = queue.NewKafkaQueueWriter(cfg.KafkaChangesTopic, producer, writerOpts...)
+	}
+	if deadLetters != nil {
+		pipe.deadLetters = deadLetters
+	}
+
+	// logic
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// a lost result stops the read loop, nothing could be committed after it
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if async != nil {
+		go func() {
+			select {
+			case <-async.Lost():
+				cancel(errResultLost)
+			case <-ctx.Done():
 			}
+		}()
+	}
+
+	if cfg.KafkaExactlyOnce {
+		pipe.transactor, err = queue.NewKafkaTransactor(ctx, producer, consumer)
+		if err != nil {
+			log.Fatalf("Error initializing transactions: %v", err)
 		}
 	}
-}
 
-func processMessage(msg []byte, qr *queue.KafkaQueueReader, qw *queue.KafkaQueueWriter, p processor.Processor) error {
-	doc, err := qr.ReadDoc(msg)
-	if err != nil {
-		log.Fatalf("Can't read doc: %v: %s", err, msg)
-		return err
+	// messages of a document are handled by one worker in the order they were read
+	workers := worker.NewPool(cfg.WorkerCount, cfg.WorkerQueueSize)
+
+	// submitErr is why the loop stopped if it was not a signal
+	var submitErr error
+	for ctx.Err() == nil {
+		msg, err := consumer.ReadMessage(100 * time.Millisecond)
+		if err != nil {
+			if kafkaErr, ok := err.(kafka.Error); ok && !kafkaErr.IsFatal() {
+				if kafkaErr.Code() != kafka.ErrTimedOut {
+					log.Printf("Consumer error: %v\n", err)
+				}
+				continue
+			}
+			log.Fatalf("Consumer error: %v (%v)\n", err, msg)
+		}
+
+		err = workers.Submit(ctx, pipe.messageKey(msg), func() {
+			err := pipe.handleMessage(ctx, msg)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Fatalf("%v: %s", err, msg.Value)
+			}
+
+			// the document is saved and delivered, the offset may be committed;
+			// in the exactly-once mode it is committed by the transaction
+			consumer.Done(msg)
+		})
+		if err != nil {
+			submitErr = err
+			break
+		}
 	}
 
-	newDoc, err := p.Process(doc)
-	if err != nil {
-		log.Fatalf("Can't process doc: %v: %s", err, msg)
-		return err
+	switch {
+	case errors.Is(context.Cause(ctx), errResultLost):
+		log.Printf("A result was lost, offsets can't be committed anymore: terminating\n")
+		exitCode = 1
+	case ctx.Err() != nil:
+		log.Printf("Caught signal: terminating\n")
+	default:
+		log.Printf("Can't submit messages: %v: terminating\n", submitErr)
 	}
+	workers.Close()
 
-	err = qw.WriteDoc(*newDoc)
-	if err != nil {
-		log.Fatalf("Can't write doc: %v: %s", err, msg)
-		return err
+	if async != nil {
+		if err := flushProducer(async, cfg.KafkaProducerFlushTimeout); err != nil {
+			log.Printf("Failed to flush producer: %v\n", err)
+		}
 	}
+}
 
-	return nil
+// flushProducer waits for the enqueued messages to be delivered, at most
+// for timeout.
+func flushProducer(async *queue.KafkaAsyncProducer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return async.Flush(ctx)
 }
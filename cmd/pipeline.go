@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"vk/internal/queue"
+	"vk/internal/retry"
+	"vk/pkg/repository"
+	processor "vk/pkg/service"
+	"vk/pkg/urlnorm"
+	"vk/pkg/validator"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Stages of the pipeline, reported in dead letters.
+const (
+	stageRead     = "read"
+	stageValidate = "validate"
+	stageProcess  = "process"
+	stageWrite    = "write"
+)
+
+// stageError is an error of a pipeline stage.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// pipeline reads a message, validates and processes the document and writes
+// the result.
+type pipeline struct {
+	reader queue.QueueReader
+	// normalizer brings message keys to the urls documents are stored by,
+	// nil when urls are not normalized
+	normalizer *urlnorm.Normalizer
+	validator  *validator.Validator
+	processor  processor.Processor
+	// retry is applied to processing and writing the results
+	retry retry.Policy
+
+	writer queue.QueueWriter
+	// noopWriter gets documents the message did not change, nil drops them
+	noopWriter queue.QueueWriter
+	// changesWriter gets change events, nil disables them
+	changesWriter queue.ChangeWriter
+	// deadLetters gets messages that failed, nil drops them
+	deadLetters queue.DeadLetterWriter
+
+	// transactor writes the results and commits the offset of a message in
+	// one Kafka transaction, nil outside of the exactly-once mode
+	transactor *queue.KafkaTransactor
+}
+
+// messageKey returns the url of the message document, so that messages of one
+// document are handled in order. The url is taken from the message key, the
+// document is decoded only for messages without a key. Messages that can't
+// be read get an empty key, they fail at the read stage anyway.
+//
+// In the exactly-once mode offsets are committed message by message, so
+// messages are keyed by partition instead.
+func (p *pipeline) messageKey(msg *kafka.Message) string {
+	if p.transactor != nil {
+		return fmt.Sprintf("%s/%d", *msg.TopicPartition.Topic, msg.TopicPartition.Partition)
+	}
+
+	url := string(msg.Key)
+	if url == "" {
+		doc, err := p.reader.ReadDoc(context.Background(), *msg.TopicPartition.Topic, msg.Value)
+		if err != nil {
+			return ""
+		}
+		url = doc.Url
+	}
+
+	if p.normalizer != nil {
+		if normalized, err := p.normalizer.Normalize(url); err == nil {
+			return normalized
+		}
+	}
+	return url
+}
+
+// handleMessage processes the message and dead-letters it once retries are
+// exhausted or the failure is permanent, so that one bad message does not stop
+// the consumer. An error is returned only if the context is done or the
+// message could not be dead-lettered.
+func (p *pipeline) handleMessage(ctx context.Context, msg *kafka.Message) error {
+	env, result, err := p.processMessage(ctx, msg)
+	if err == nil {
+		err = p.retry.Do(ctx, func(ctx context.Context) error {
+			return p.transaction(ctx, msg, func(ctx context.Context) error {
+				return p.writeResult(ctx, env, result)
+			})
+		})
+	}
+	if err == nil || ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, queue.ErrPartitionRevoked) {
+		log.Printf("Skipping message %v: %v", msg.TopicPartition, err)
+		return nil
+	}
+
+	stage := stageWrite
+	var failed *stageError
+	if errors.As(err, &failed) {
+		stage = failed.stage
+	}
+
+	if p.deadLetters == nil {
+		log.Printf("Skipping message %v at %s stage: %v", msg.TopicPartition, stage, err)
+		return p.transaction(ctx, msg, func(context.Context) error { return nil })
+	}
+
+	log.Printf("Dead-lettering message %v at %s stage: %v", msg.TopicPartition, stage, err)
+	err = p.transaction(ctx, msg, func(ctx context.Context) error {
+		return p.deadLetters.WriteDeadLetter(ctx, msg, stage, err)
+	})
+	if err != nil {
+		return fmt.Errorf("can't write dead letter: %w", err)
+	}
+	return nil
+}
+
+// transaction runs fn in a Kafka transaction that commits the message offset
+// in the exactly-once mode and just calls fn otherwise.
+func (p *pipeline) transaction(ctx context.Context, msg *kafka.Message, fn func(ctx context.Context) error) error {
+	if p.transactor == nil {
+		return fn(ctx)
+	}
+	return p.transactor.Run(ctx, msg, fn)
+}
+
+func (p *pipeline) processMessage(ctx context.Context, msg *kafka.Message) (*queue.Envelope, *processor.Result, error) {
+	env, err := p.reader.ReadEnvelope(ctx, msg)
+	if err != nil {
+		return nil, nil, &stageError{stageRead, fmt.Errorf("can't read doc: %w", err)}
+	}
+	doc := env.Document
+
+	if err := p.validator.Validate(doc); err != nil {
+		return nil, nil, &stageError{stageValidate, err}
+	}
+
+	if p.transactor != nil {
+		// a message redelivered after a failed transaction is not saved twice
+		ctx = repository.WithMessageID(ctx, repository.MessageID{
+			Topic:     *msg.TopicPartition.Topic,
+			Partition: msg.TopicPartition.Partition,
+			Offset:    int64(msg.TopicPartition.Offset),
+		})
+	}
+
+	var result *processor.Result
+	err = p.retry.Do(ctx, func(ctx context.Context) error {
+		result, err = p.processor.Process(ctx, doc)
+		return err
+	})
+	if err != nil {
+		return nil, nil, &stageError{stageProcess, fmt.Errorf("can't process doc: %w", err)}
+	}
+
+	return env, result, nil
+}
+
+// writeResult writes the result with the headers of the message it was
+// processed from, so that the trace id is carried over.
+func (p *pipeline) writeResult(ctx context.Context, env *queue.Envelope, result *processor.Result) error {
+	writer := p.writer
+	if !result.Changed() {
+		if p.noopWriter == nil {
+			return nil
+		}
+		writer = p.noopWriter
+	}
+
+	out := env.Forward(result.Document)
+
+	err := writer.WriteEnvelope(ctx, out)
+	if err != nil {
+		return &stageError{stageWrite, fmt.Errorf("can't write doc: %w", err)}
+	}
+
+	if p.changesWriter != nil && result.Diff != nil {
+		err = p.changesWriter.WriteChange(ctx, out, *result.Diff)
+		if err != nil {
+			return &stageError{stageWrite, fmt.Errorf("can't write change: %w", err)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"vk/internal/queue"
+	"vk/internal/retry"
+	"vk/pkg/model"
+	"vk/pkg/proto"
+	"vk/pkg/repository"
+	processor "vk/pkg/service"
+	"vk/pkg/urlnorm"
+	"vk/pkg/validator"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+// fakeWriter records written documents and changes, or fails with err.
+type fakeWriter struct {
+	mutex   sync.Mutex
+	err     error
+	docs    []*queue.Envelope
+	changes []model.DocumentChange
+}
+
+func (w *fakeWriter) WriteEnvelope(_ context.Context, env *queue.Envelope) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	w.docs = append(w.docs, env)
+	return nil
+}
+
+func (w *fakeWriter) WriteDoc(ctx context.Context, doc model.Document) error {
+	return w.WriteEnvelope(ctx, &queue.Envelope{Document: &doc})
+}
+
+func (w *fakeWriter) WriteChange(_ context.Context, _ *queue.Envelope, change model.DocumentChange) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	w.changes = append(w.changes, change)
+	return nil
+}
+
+// fakeDeadLetters records the stages of dead-lettered messages.
+type fakeDeadLetters struct {
+	err    error
+	stages []string
+}
+
+func (d *fakeDeadLetters) WriteDeadLetter(_ context.Context, _ *kafka.Message, stage string, _ error) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.stages = append(d.stages, stage)
+	return nil
+}
+
+func testPipeline() *pipeline {
+	return &pipeline{
+		reader:    queue.NewKafkaQueueReader(),
+		validator: validator.New(validator.RequireURL),
+		processor: processor.NewProcessor(repository.NewInMemoryRepository()),
+		retry:     retry.Policy{MaxAttempts: 1},
+		writer:    &fakeWriter{},
+	}
+}
+
+func testMessage(t *testing.T, doc *proto.TDocument) *kafka.Message {
+	value, err := gproto.Marshal(doc)
+	require.NoError(t, err)
+
+	topic := "documents-in"
+	return &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 7},
+		Key:            []byte(doc.Url),
+		Value:          value,
+	}
+}
+
+func TestPipeline_HandleMessage(t *testing.T) {
+	pipe := testPipeline()
+	writer := pipe.writer.(*fakeWriter)
+	changes := &fakeWriter{}
+	pipe.changesWriter = changes
+
+	msg := testMessage(t, &proto.TDocument{Url: "http://example.com/", FetchTime: 10, Text: "text"})
+	require.NoError(t, pipe.handleMessage(context.Background(), msg))
+
+	require.Len(t, writer.docs, 1)
+	out := writer.docs[0]
+	assert.Equal(t, "text", out.Document.Text)
+	_, ok := out.Header(queue.HeaderTraceID)
+	assert.True(t, ok, "expected the trace id to be carried over")
+	offset, _ := out.Header(queue.HeaderSourceOffset)
+	assert.Equal(t, "7", offset)
+
+	require.Len(t, changes.changes, 1)
+	assert.True(t, changes.changes[0].New)
+
+	require.NoError(t, pipe.handleMessage(context.Background(), msg))
+	assert.Len(t, writer.docs, 1, "expected an unchanged document to be dropped without a noop writer")
+	assert.Len(t, changes.changes, 1, "expected no change event for an unchanged document")
+
+	noop := &fakeWriter{}
+	pipe.noopWriter = noop
+	require.NoError(t, pipe.handleMessage(context.Background(), msg))
+	assert.Len(t, noop.docs, 1, "expected an unchanged document to go to the noop writer")
+}
+
+func TestPipeline_DeadLetters(t *testing.T) {
+	pipe := testPipeline()
+	deadLetters := &fakeDeadLetters{}
+	pipe.deadLetters = deadLetters
+
+	garbage := testMessage(t, &proto.TDocument{Url: "http://example.com/"})
+	garbage.Value = []byte{0xff}
+	require.NoError(t, pipe.handleMessage(context.Background(), garbage))
+
+	require.NoError(t, pipe.handleMessage(context.Background(), testMessage(t, &proto.TDocument{FetchTime: 10})))
+
+	pipe.writer.(*fakeWriter).err = errors.New("broker down")
+	require.NoError(t, pipe.handleMessage(context.Background(), testMessage(t, &proto.TDocument{Url: "http://example.com/", FetchTime: 10})))
+
+	assert.Equal(t, []string{stageRead, stageValidate, stageWrite}, deadLetters.stages)
+
+	deadLetters.err = errors.New("broker down")
+	err := pipe.handleMessage(context.Background(), testMessage(t, &proto.TDocument{FetchTime: 10}))
+	assert.Error(t, err, "expected a failed dead letter to be returned")
+
+	pipe.deadLetters = nil
+	err = pipe.handleMessage(context.Background(), testMessage(t, &proto.TDocument{FetchTime: 10}))
+	assert.NoError(t, err, "expected the message to be skipped without dead letters")
+}
+
+func TestPipeline_MessageKey(t *testing.T) {
+	pipe := testPipeline()
+
+	msg := testMessage(t, &proto.TDocument{Url: "http://example.com/doc"})
+	msg.Key = []byte("http://example.com/key")
+	assert.Equal(t, "http://example.com/key", pipe.messageKey(msg), "expected the message key")
+
+	msg.Key = nil
+	assert.Equal(t, "http://example.com/doc", pipe.messageKey(msg), "expected the document url without a key")
+
+	msg.Value = []byte{0xff}
+	assert.Empty(t, pipe.messageKey(msg), "expected no key for a message that can't be read")
+
+	pipe.normalizer = urlnorm.New()
+	msg.Key = []byte("HTTP://Example.com/key")
+	assert.Equal(t, "http://example.com/key", pipe.messageKey(msg), "expected the key to be normalized")
+}
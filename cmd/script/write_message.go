@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"vk/internal/config"
 	"vk/internal/queue"
 	"vk/pkg/model"
+	"vk/pkg/urlnorm"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/joho/godotenv"
@@ -32,14 +35,42 @@ func main() {
 
 	producer, err := kafka.NewProducer(&kafka.ConfigMap{
 		"bootstrap.servers": fmt.Sprintf("%s:%s", cfg.KafkaBrokerHost, cfg.KafkaBrokerPort),
+		"partitioner":       cfg.KafkaPartitioner,
 	})
 	if err != nil {
 		panic(err)
 	}
 	defer producer.Close()
 
-	q := queue.NewKafkaQueueWriter(cfg.KafkaInTopic, producer)
-	q.WriteDoc(*doc)
+	var registry queue.SchemaRegistry
+	if cfg.SchemaRegistryPath != "" {
+		registry, err = queue.NewFileRegistry(cfg.SchemaRegistryPath)
+		if err != nil {
+			log.Fatalf("Error loading schema registry: %v", err)
+		}
+	}
+
+	codecs, err := queue.ParseCodecs(cfg.KafkaCodec, cfg.KafkaTopicCodecs, registry)
+	if err != nil {
+		log.Fatalf("Error parsing codecs: %v", err)
+	}
+
+	writerOpts := []queue.WriterOption{queue.WithWriterCodec(codecs)}
+
+	// the message is keyed by the url the processor stores the document by,
+	// so that messages of a document are read in order
+	if cfg.URLNormalize {
+		normalizerOpts := []urlnorm.Option{urlnorm.WithScheme(cfg.URLScheme)}
+		if cfg.URLTrackingParams != "" {
+			normalizerOpts = append(normalizerOpts, urlnorm.WithTrackingParams(strings.Split(cfg.URLTrackingParams, ",")...))
+		}
+		writerOpts = append(writerOpts, queue.WithKeyNormalizer(urlnorm.New(normalizerOpts...)))
+	}
+
+	q := queue.NewKafkaQueueWriter(cfg.KafkaInTopic, producer, writerOpts...)
+	if err := q.WriteDoc(context.Background(), *doc); err != nil {
+		log.Fatalf("Error writing message: %v", err)
+	}
 }
 
 func ParseDocumentFromFlags() (*model.Document, error) {
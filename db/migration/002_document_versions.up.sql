@@ -0,0 +1,8 @@
+CREATE TABLE document_versions (
+    url                 TEXT    NOT NULL,
+    pub_date            BIGINT  NOT NULL,
+    fetch_time          BIGINT  NOT NULL,
+    text                TEXT    NOT NULL,
+    first_fetch_time    BIGINT  NOT NULL,
+    PRIMARY KEY (url, fetch_time)
+);
@@ -0,0 +1 @@
+ALTER TABLE documents ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+ALTER TABLE documents ADD COLUMN provenance JSONB NOT NULL DEFAULT '{}';
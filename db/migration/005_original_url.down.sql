@@ -0,0 +1,2 @@
+ALTER TABLE document_versions DROP COLUMN original_url;
+ALTER TABLE documents DROP COLUMN original_url;
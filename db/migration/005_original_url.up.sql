@@ -0,0 +1,2 @@
+ALTER TABLE documents ADD COLUMN original_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE document_versions ADD COLUMN original_url TEXT NOT NULL DEFAULT '';
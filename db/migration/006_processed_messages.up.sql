@@ -0,0 +1,7 @@
+CREATE TABLE processed_messages (
+    kafka_topic         TEXT    NOT NULL,
+    kafka_partition     INTEGER NOT NULL,
+    kafka_offset        BIGINT  NOT NULL,
+    url                 TEXT    NOT NULL,
+    PRIMARY KEY (kafka_topic, kafka_partition, kafka_offset)
+);
@@ -1,7 +1,29 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	ProcessorModeLock       = "lock"
+	ProcessorModeOptimistic = "optimistic"
+)
+
+const (
+	RepositoryPostgres      = "postgres"
+	RepositoryMemory        = "memory"
+	RepositoryShardedMemory = "sharded-memory"
+	RepositoryBolt          = "bolt"
+)
+
+const (
+	ValidationRuleURL             = "url"
+	ValidationRuleFetchTime       = "fetch-time"
+	ValidationRuleFutureFetchTime = "future-fetch-time"
+	ValidationRuleTextSize        = "text-size"
 )
 
 type Config struct {
@@ -11,10 +33,56 @@ type Config struct {
 	PostgresHost     string
 	PostgresPort     string
 
-	KafkaBrokerHost string
-	KafkaBrokerPort string
-	KafkaInTopic    string
-	KafkaOutTopic   string
+	RepositoryType         string
+	MemoryShardCount       int
+	MemoryDataDir          string
+	MemorySnapshotInterval time.Duration
+	BoltPath               string
+
+	KafkaBrokerHost   string
+	KafkaBrokerPort   string
+	KafkaInTopic      string
+	KafkaOutTopic     string
+	KafkaNoopTopic    string
+	KafkaChangesTopic string
+	KafkaDLQTopic     string
+	KafkaPartitioner  string
+
+	KafkaCodec         string
+	KafkaTopicCodecs   string
+	SchemaRegistryPath string
+
+	KafkaCommitInterval  time.Duration
+	KafkaExactlyOnce     bool
+	KafkaTransactionalID string
+
+	KafkaProducerAsync        bool
+	KafkaProducerLinger       time.Duration
+	KafkaProducerBatchSize    int
+	KafkaProducerCompression  string
+	KafkaProducerFlushTimeout time.Duration
+
+	ProcessorMode       string
+	ProcessorMaxRetries int
+	MergeStrategy       string
+	MergeFieldRules     string
+
+	LockTimeout time.Duration
+
+	URLNormalize      bool
+	URLScheme         string
+	URLTrackingParams string
+
+	ValidationRules        string
+	ValidationMaxTextSize  int
+	ValidationMaxClockSkew time.Duration
+
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+
+	WorkerCount     int
+	WorkerQueueSize int
 }
 
 func LoadConfig() (*Config, error) {
@@ -25,11 +93,102 @@ func LoadConfig() (*Config, error) {
 		PostgresHost:     getEnv("POSTGRES_HOST", ""),
 		PostgresPort:     getEnv("POSTGRES_PORT", ""),
 
-		KafkaBrokerHost: getEnv("KAFKA_BROKER_HOST", ""),
-		KafkaBrokerPort: getEnv("KAFKA_BROKER_PORT", ""),
-		KafkaInTopic:    getEnv("KAFKA_IN_TOPIC", ""),
-		KafkaOutTopic:   getEnv("KAFKA_OUT_TOPIC", ""),
+		RepositoryType: getEnv("REPOSITORY_TYPE", RepositoryPostgres),
+		MemoryDataDir:  getEnv("MEMORY_DATA_DIR", ""),
+		BoltPath:       getEnv("BOLT_PATH", "documents.db"),
+
+		KafkaBrokerHost:   getEnv("KAFKA_BROKER_HOST", ""),
+		KafkaBrokerPort:   getEnv("KAFKA_BROKER_PORT", ""),
+		KafkaInTopic:      getEnv("KAFKA_IN_TOPIC", ""),
+		KafkaOutTopic:     getEnv("KAFKA_OUT_TOPIC", ""),
+		KafkaNoopTopic:    getEnv("KAFKA_NOOP_TOPIC", ""),
+		KafkaChangesTopic: getEnv("KAFKA_CHANGES_TOPIC", ""),
+		KafkaDLQTopic:     getEnv("KAFKA_DLQ_TOPIC", ""),
+		KafkaPartitioner:  getEnv("KAFKA_PARTITIONER", "consistent_random"),
+
+		KafkaCodec:         getEnv("KAFKA_CODEC", "protobuf"),
+		KafkaTopicCodecs:   getEnv("KAFKA_TOPIC_CODECS", ""),
+		SchemaRegistryPath: getEnv("SCHEMA_REGISTRY_PATH", ""),
+
+		KafkaTransactionalID: getEnv("KAFKA_TRANSACTIONAL_ID", ""),
+
+		KafkaProducerCompression: getEnv("KAFKA_PRODUCER_COMPRESSION", "none"),
+
+		ProcessorMode:   getEnv("PROCESSOR_MODE", ProcessorModeLock),
+		MergeStrategy:   getEnv("MERGE_STRATEGY", "latest"),
+		MergeFieldRules: getEnv("MERGE_FIELD_RULES", ""),
+
+		URLScheme:         getEnv("URL_SCHEME", ""),
+		URLTrackingParams: getEnv("URL_TRACKING_PARAMS", ""),
+
+		ValidationRules: getEnv("VALIDATION_RULES", "url,fetch-time,future-fetch-time,text-size"),
+	}
+
+	var err error
+	if config.MemoryShardCount, err = getEnvInt("MEMORY_SHARD_COUNT", 16); err != nil {
+		return nil, err
+	}
+	if config.MemorySnapshotInterval, err = getEnvDuration("MEMORY_SNAPSHOT_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if config.ProcessorMaxRetries, err = getEnvInt("PROCESSOR_MAX_RETRIES", 5); err != nil {
+		return nil, err
+	}
+	if config.LockTimeout, err = getEnvDuration("LOCK_TIMEOUT", 0); err != nil {
+		return nil, err
+	}
+	if config.URLNormalize, err = getEnvBool("URL_NORMALIZE", false); err != nil {
+		return nil, err
+	}
+	if config.ValidationMaxTextSize, err = getEnvInt("VALIDATION_MAX_TEXT_SIZE", 10<<20); err != nil {
+		return nil, err
 	}
+	if config.ValidationMaxClockSkew, err = getEnvDuration("VALIDATION_MAX_CLOCK_SKEW", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if config.RetryMaxAttempts, err = getEnvInt("RETRY_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if config.RetryInitialBackoff, err = getEnvDuration("RETRY_INITIAL_BACKOFF", 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if config.RetryMaxBackoff, err = getEnvDuration("RETRY_MAX_BACKOFF", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if config.KafkaCommitInterval, err = getEnvDuration("KAFKA_COMMIT_INTERVAL", time.Second); err != nil {
+		return nil, err
+	}
+	if config.KafkaExactlyOnce, err = getEnvBool("KAFKA_EXACTLY_ONCE", false); err != nil {
+		return nil, err
+	}
+	if config.KafkaExactlyOnce && config.RepositoryType != RepositoryPostgres {
+		// only PostgreSQL skips messages redelivered after a failed transaction
+		return nil, fmt.Errorf("KAFKA_EXACTLY_ONCE requires REPOSITORY_TYPE=%s, got %s", RepositoryPostgres, config.RepositoryType)
+	}
+	if config.KafkaExactlyOnce && config.KafkaTransactionalID == "" {
+		// the id must survive restarts, so that the old producer of the
+		// instance is fenced
+		return nil, fmt.Errorf("KAFKA_EXACTLY_ONCE requires KAFKA_TRANSACTIONAL_ID")
+	}
+	if config.KafkaProducerAsync, err = getEnvBool("KAFKA_PRODUCER_ASYNC", false); err != nil {
+		return nil, err
+	}
+	if config.KafkaProducerLinger, err = getEnvDuration("KAFKA_PRODUCER_LINGER", 5*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if config.KafkaProducerBatchSize, err = getEnvInt("KAFKA_PRODUCER_BATCH_SIZE", 1000000); err != nil {
+		return nil, err
+	}
+	if config.KafkaProducerFlushTimeout, err = getEnvDuration("KAFKA_PRODUCER_FLUSH_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if config.WorkerCount, err = getEnvInt("WORKER_COUNT", 8); err != nil {
+		return nil, err
+	}
+	if config.WorkerQueueSize, err = getEnvInt("WORKER_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
@@ -39,3 +198,42 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value: %v", key, err)
+	}
+	return parsed, nil
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value: %v", key, err)
+	}
+	return parsed, nil
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s value: %v", key, err)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,235 @@
+package queue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	gproto "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Names of the codecs in the codec settings.
+const (
+	CodecProtobuf         = "protobuf"
+	CodecJSON             = "json"
+	CodecRegistryProtobuf = "registry-protobuf"
+)
+
+var (
+	ErrUnknownCodec   = errors.New("unknown codec")
+	ErrInvalidFraming = errors.New("invalid schema registry framing")
+	ErrUnknownSchema  = errors.New("unknown schema id")
+)
+
+// Codec encodes TDocument and TDocumentChange messages to message values of
+// a topic and decodes them back.
+type Codec interface {
+	Marshal(topic string, m gproto.Message) ([]byte, error)
+	Unmarshal(topic string, data []byte, m gproto.Message) error
+}
+
+// ProtobufCodec is the protobuf binary encoding.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(_ string, m gproto.Message) ([]byte, error) {
+	return gproto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(_ string, data []byte, m gproto.Message) error {
+	return gproto.Unmarshal(data, m)
+}
+
+// JSONCodec is the canonical protobuf JSON encoding. Unknown fields are
+// ignored, as they are in the binary encoding.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(_ string, m gproto.Message) ([]byte, error) {
+	return protojson.Marshal(m)
+}
+
+func (JSONCodec) Unmarshal(_ string, data []byte, m gproto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+}
+
+// SchemaRegistry maps subjects to schema ids.
+type SchemaRegistry interface {
+	// SchemaID returns the id of the schema of the subject.
+	SchemaID(subject string) (int32, error)
+	// Subjects returns the subjects the schema id is registered for.
+	Subjects(id int32) ([]string, error)
+}
+
+// RegistryCodec is protobuf in the schema registry wire format: a zero magic
+// byte, a big-endian 4-byte schema id and the indexes of the message in the
+// .proto file, followed by the protobuf binary encoding. Schemas are looked
+// up by the "<topic>-value" subject.
+type RegistryCodec struct {
+	registry SchemaRegistry
+}
+
+func NewRegistryCodec(registry SchemaRegistry) *RegistryCodec {
+	return &RegistryCodec{registry: registry}
+}
+
+func (c *RegistryCodec) Marshal(topic string, m gproto.Message) ([]byte, error) {
+	id, err := c.registry.SchemaID(topic + "-value")
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 5, 16)
+	binary.BigEndian.PutUint32(buf[1:], uint32(id))
+	buf = appendMessageIndexes(buf, messageIndexes(m.ProtoReflect().Descriptor()))
+
+	return gproto.MarshalOptions{}.MarshalAppend(buf, m)
+}
+
+// Unmarshal accepts only schema ids registered for the subject of the topic.
+func (c *RegistryCodec) Unmarshal(topic string, data []byte, m gproto.Message) error {
+	if len(data) < 5 || data[0] != 0 {
+		return fmt.Errorf("%w: no magic byte", ErrInvalidFraming)
+	}
+
+	id := int32(binary.BigEndian.Uint32(data[1:5]))
+	subjects, err := c.registry.Subjects(id)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(subjects, topic+"-value") {
+		return fmt.Errorf("%w: %d is not registered for %s-value", ErrUnknownSchema, id, topic)
+	}
+
+	indexes, n, err := consumeMessageIndexes(data[5:])
+	if err != nil {
+		return err
+	}
+	if expected := messageIndexes(m.ProtoReflect().Descriptor()); !slices.Equal(indexes, expected) {
+		return fmt.Errorf("%w: message indexes %v, expected %v", ErrInvalidFraming, indexes, expected)
+	}
+
+	return gproto.Unmarshal(data[5+n:], m)
+}
+
+// messageIndexes returns the path to the message in its .proto file: the
+// index of the top-level message followed by the indexes of nested ones.
+func messageIndexes(desc protoreflect.MessageDescriptor) []int {
+	var indexes []int
+	for d := protoreflect.Descriptor(desc); ; d = d.Parent() {
+		md, ok := d.(protoreflect.MessageDescriptor)
+		if !ok {
+			break
+		}
+		indexes = append([]int{md.Index()}, indexes...)
+	}
+	return indexes
+}
+
+// appendMessageIndexes writes the zigzag varint count and indexes, or
+// a single zero for the first message of the file.
+func appendMessageIndexes(b []byte, indexes []int) []byte {
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return append(b, 0)
+	}
+
+	b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(len(indexes))))
+	for _, index := range indexes {
+		b = protowire.AppendVarint(b, protowire.EncodeZigZag(int64(index)))
+	}
+	return b
+}
+
+func consumeMessageIndexes(b []byte) ([]int, int, error) {
+	count, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return nil, 0, fmt.Errorf("%w: %v", ErrInvalidFraming, protowire.ParseError(n))
+	}
+	if count == 0 {
+		return []int{0}, n, nil
+	}
+
+	total := n
+	indexes := make([]int, 0, 1)
+	for i := int64(0); i < protowire.DecodeZigZag(count); i++ {
+		index, n := protowire.ConsumeVarint(b[total:])
+		if n < 0 {
+			return nil, 0, fmt.Errorf("%w: %v", ErrInvalidFraming, protowire.ParseError(n))
+		}
+		indexes = append(indexes, int(protowire.DecodeZigZag(index)))
+		total += n
+	}
+	return indexes, total, nil
+}
+
+// TopicCodecs picks the codec by topic, topics without a codec of their own
+// use the default one.
+type TopicCodecs struct {
+	defaultCodec Codec
+	topics       map[string]Codec
+}
+
+func (c *TopicCodecs) Marshal(topic string, m gproto.Message) ([]byte, error) {
+	return c.codec(topic).Marshal(topic, m)
+}
+
+func (c *TopicCodecs) Unmarshal(topic string, data []byte, m gproto.Message) error {
+	return c.codec(topic).Unmarshal(topic, data, m)
+}
+
+func (c *TopicCodecs) codec(topic string) Codec {
+	if codec, ok := c.topics[topic]; ok {
+		return codec
+	}
+	return c.defaultCodec
+}
+
+// ParseCodecs builds codecs from the default codec name and a comma-separated
+// list of per-topic codecs, e.g. "documents-in=json,documents-out=protobuf".
+// The registry is needed only by registry-protobuf.
+func ParseCodecs(defaultName, topics string, registry SchemaRegistry) (*TopicCodecs, error) {
+	defaultCodec, err := NewCodec(defaultName, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	codecs := &TopicCodecs{defaultCodec: defaultCodec, topics: make(map[string]Codec)}
+	for _, pair := range strings.Split(topics, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		topic, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid topic codec %q, expected topic=codec", pair)
+		}
+
+		codec, err := NewCodec(strings.TrimSpace(name), registry)
+		if err != nil {
+			return nil, err
+		}
+		codecs.topics[strings.TrimSpace(topic)] = codec
+	}
+	return codecs, nil
+}
+
+// NewCodec returns the codec by its name.
+func NewCodec(name string, registry SchemaRegistry) (Codec, error) {
+	switch name {
+	case CodecProtobuf:
+		return ProtobufCodec{}, nil
+	case CodecJSON:
+		return JSONCodec{}, nil
+	case CodecRegistryProtobuf:
+		if registry == nil {
+			return nil, fmt.Errorf("codec %s needs a schema registry", name)
+		}
+		return NewRegistryCodec(registry), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+}
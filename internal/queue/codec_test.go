@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vk/pkg/proto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func testRegistry(t *testing.T) *FileRegistry {
+	path := filepath.Join(t.TempDir(), "schema-registry.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"documents-in-value": 1, "documents-out-value": 1, "documents-changes-value": 258}`), 0o644))
+
+	registry, err := NewFileRegistry(path)
+	require.NoError(t, err)
+	return registry
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	doc := &proto.TDocument{
+		Url:        "http://example.com/",
+		PubDate:    1,
+		FetchTime:  2,
+		Text:       "text",
+		Provenance: map[string]uint64{"Text": 2},
+	}
+
+	for name, codec := range map[string]Codec{
+		CodecProtobuf:         ProtobufCodec{},
+		CodecJSON:             JSONCodec{},
+		CodecRegistryProtobuf: NewRegistryCodec(testRegistry(t)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Marshal("documents-in", doc)
+			require.NoError(t, err)
+
+			decoded := &proto.TDocument{}
+			require.NoError(t, codec.Unmarshal("documents-in", data, decoded))
+			assert.True(t, gproto.Equal(doc, decoded), "expected %v, got %v", doc, decoded)
+		})
+	}
+}
+
+func TestJSONCodec_Unmarshal(t *testing.T) {
+	doc := &proto.TDocument{}
+	err := JSONCodec{}.Unmarshal("documents-in", []byte(`{"Url": "http://example.com/", "FetchTime": "3", "source": "crawler"}`), doc)
+	require.NoError(t, err, "expected unknown fields to be ignored")
+	assert.Equal(t, "http://example.com/", doc.Url)
+	assert.Equal(t, uint64(3), doc.FetchTime)
+}
+
+func TestRegistryCodec_Framing(t *testing.T) {
+	codec := NewRegistryCodec(testRegistry(t))
+
+	data, err := codec.Marshal("documents-in", &proto.TDocument{Url: "u"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 1, 0}, data[:6], "expected the magic byte, the schema id and a zero index of the first message")
+
+	data, err = codec.Marshal("documents-changes", &proto.TDocumentChange{Url: "u"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 1, 2, 2, 2}, data[:7], "expected one zigzag index of the second message")
+
+	decoded := &proto.TDocumentChange{}
+	require.NoError(t, codec.Unmarshal("documents-changes", data, decoded))
+	assert.Equal(t, "u", decoded.Url)
+
+	err = codec.Unmarshal("documents-changes", data, &proto.TDocument{})
+	assert.ErrorIs(t, err, ErrInvalidFraming, "expected a message of another type to be rejected")
+
+	err = codec.Unmarshal("documents-in", data, &proto.TDocumentChange{})
+	assert.ErrorIs(t, err, ErrUnknownSchema, "expected a schema id of another subject to be rejected")
+
+	_, err = codec.Marshal("documents-noop", &proto.TDocument{Url: "u"})
+	assert.ErrorIs(t, err, ErrUnknownSchema, "expected no schema for the subject")
+
+	err = codec.Unmarshal("documents-in", []byte{0, 0, 0, 0, 7, 0}, &proto.TDocument{})
+	assert.ErrorIs(t, err, ErrUnknownSchema, "expected an unregistered schema id to be rejected")
+
+	plain, err := gproto.Marshal(&proto.TDocument{Url: "u"})
+	require.NoError(t, err)
+	err = codec.Unmarshal("documents-in", plain, &proto.TDocument{})
+	assert.ErrorIs(t, err, ErrInvalidFraming, "expected a message without the magic byte to be rejected")
+}
+
+func TestParseCodecs(t *testing.T) {
+	codecs, err := ParseCodecs(CodecProtobuf, "documents-in=json, documents-out = registry-protobuf", testRegistry(t))
+	require.NoError(t, err)
+	assert.Equal(t, JSONCodec{}, codecs.codec("documents-in"))
+	assert.IsType(t, &RegistryCodec{}, codecs.codec("documents-out"))
+	assert.Equal(t, ProtobufCodec{}, codecs.codec("documents-noop"), "expected the default codec")
+
+	_, err = ParseCodecs(CodecProtobuf, "documents-in=avro", nil)
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+
+	_, err = ParseCodecs(CodecProtobuf, "documents-in", nil)
+	assert.Error(t, err, "expected a topic without a codec to be rejected")
+
+	_, err = ParseCodecs(CodecRegistryProtobuf, "", nil)
+	assert.Error(t, err, "expected registry-protobuf to need a registry")
+}
+
+func TestRegistryCodec_SharedSchemaID(t *testing.T) {
+	codec := NewRegistryCodec(testRegistry(t))
+
+	data, err := codec.Marshal("documents-in", &proto.TDocument{Url: "u"})
+	require.NoError(t, err)
+
+	for _, topic := range []string{"documents-in", "documents-out"} {
+		assert.NoError(t, codec.Unmarshal(topic, data, &proto.TDocument{}), "expected the shared schema id to be accepted for %s", topic)
+	}
+}
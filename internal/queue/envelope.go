@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"vk/pkg/model"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// SchemaVersion is the version of the TDocument and TDocumentChange schemas
+// in docs/tdocument.proto written to the schema-version header.
+const SchemaVersion = "1"
+
+// Headers propagated from input to output messages.
+const (
+	HeaderTraceID         = "trace-id"
+	HeaderSchemaVersion   = "schema-version"
+	HeaderProducerHost    = "producer-host"
+	HeaderSourceTopic     = "source-topic"
+	HeaderSourcePartition = "source-partition"
+	HeaderSourceOffset    = "source-offset"
+)
+
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// producerHost is written to the producer-host header.
+var producerHost, _ = os.Hostname()
+
+// Envelope is a document together with the Kafka message carrying it.
+type Envelope struct {
+	Key       []byte
+	Headers   []kafka.Header
+	Timestamp time.Time
+	Topic     string
+	Partition int32
+	Offset    kafka.Offset
+	Document  *model.Document
+}
+
+// Header returns the last value of the header.
+func (e *Envelope) Header(key string) (string, bool) {
+	for i := len(e.Headers) - 1; i >= 0; i-- {
+		if e.Headers[i].Key == key {
+			return string(e.Headers[i].Value), true
+		}
+	}
+	return "", false
+}
+
+// SetHeader replaces all values of the header with value.
+func (e *Envelope) SetHeader(key, value string) {
+	headers := make([]kafka.Header, 0, len(e.Headers)+1)
+	for _, header := range e.Headers {
+		if header.Key != key {
+			headers = append(headers, header)
+		}
+	}
+	e.Headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// Forward returns an envelope for a document produced from the message of e.
+// It keeps the headers, including the trace id, and records where the message
+// was read from in the source-* headers.
+func (e *Envelope) Forward(doc *model.Document) *Envelope {
+	forward := &Envelope{
+		Headers:  append([]kafka.Header(nil), e.Headers...),
+		Document: doc,
+	}
+	forward.SetHeader(HeaderSourceTopic, e.Topic)
+	forward.SetHeader(HeaderSourcePartition, strconv.Itoa(int(e.Partition)))
+	forward.SetHeader(HeaderSourceOffset, strconv.FormatInt(int64(e.Offset), 10))
+	return forward
+}
+
+// ensureTraceID starts a new trace for a message that is not part of one.
+func (e *Envelope) ensureTraceID() {
+	if _, ok := e.Header(HeaderTraceID); ok {
+		return
+	}
+
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	e.SetHeader(HeaderTraceID, hex.EncodeToString(id))
+}
@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"context"
+	"testing"
+
+	"vk/pkg/model"
+	"vk/pkg/proto"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func TestEnvelope_Headers(t *testing.T) {
+	env := &Envelope{Headers: []kafka.Header{
+		{Key: HeaderTraceID, Value: []byte("first")},
+		{Key: "other", Value: []byte("value")},
+		{Key: HeaderTraceID, Value: []byte("second")},
+	}}
+
+	traceID, ok := env.Header(HeaderTraceID)
+	assert.True(t, ok)
+	assert.Equal(t, "second", traceID, "expected the last value of the header")
+
+	_, ok = env.Header(HeaderSchemaVersion)
+	assert.False(t, ok, "expected no header")
+
+	env.SetHeader(HeaderTraceID, "third")
+	assert.Equal(t, []kafka.Header{
+		{Key: "other", Value: []byte("value")},
+		{Key: HeaderTraceID, Value: []byte("third")},
+	}, env.Headers, "expected all values of the header to be replaced")
+}
+
+func TestEnvelope_Forward(t *testing.T) {
+	env := &Envelope{
+		Key:       []byte("http://example.com/"),
+		Headers:   []kafka.Header{{Key: HeaderTraceID, Value: []byte("trace")}},
+		Topic:     "documents-in",
+		Partition: 3,
+		Offset:    42,
+		Document:  &model.Document{Url: "http://example.com/"},
+	}
+	doc := &model.Document{Url: "http://example.com/", Version: 2}
+
+	forward := env.Forward(doc)
+	assert.Nil(t, forward.Key, "expected the key to be derived from the document")
+	assert.Same(t, doc, forward.Document)
+
+	for header, expected := range map[string]string{
+		HeaderTraceID:         "trace",
+		HeaderSourceTopic:     "documents-in",
+		HeaderSourcePartition: "3",
+		HeaderSourceOffset:    "42",
+	} {
+		value, _ := forward.Header(header)
+		assert.Equal(t, expected, value, header)
+	}
+	assert.Len(t, env.Headers, 1, "expected the headers of the message to stay intact")
+}
+
+func TestKafkaQueueReader_ReadEnvelope(t *testing.T) {
+	value, err := gproto.Marshal(&proto.TDocument{Url: "http://example.com/", FetchTime: 10})
+	require.NoError(t, err)
+
+	topic := "documents-in"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 7},
+		Key:            []byte("http://example.com/"),
+		Value:          value,
+	}
+
+	reader := NewKafkaQueueReader()
+	env, err := reader.ReadEnvelope(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, "documents-in", env.Topic)
+	assert.Equal(t, int32(1), env.Partition)
+	assert.Equal(t, kafka.Offset(7), env.Offset)
+	assert.Equal(t, msg.Key, env.Key)
+	assert.Equal(t, "http://example.com/", env.Document.Url)
+
+	traceID, ok := env.Header(HeaderTraceID)
+	assert.True(t, ok, "expected a new trace for a message without a trace id")
+	assert.Len(t, traceID, 32)
+	assert.Empty(t, msg.Headers, "expected the message headers to stay intact")
+
+	msg.Headers = []kafka.Header{
+		{Key: HeaderTraceID, Value: []byte("trace")},
+		{Key: HeaderSchemaVersion, Value: []byte(SchemaVersion)},
+	}
+	env, err = reader.ReadEnvelope(context.Background(), msg)
+	require.NoError(t, err)
+	traceID, _ = env.Header(HeaderTraceID)
+	assert.Equal(t, "trace", traceID, "expected the trace id of the message")
+
+	msg.Headers = []kafka.Header{{Key: HeaderSchemaVersion, Value: []byte("2")}}
+	_, err = reader.ReadEnvelope(context.Background(), msg)
+	assert.ErrorIs(t, err, ErrUnsupportedSchemaVersion)
+}
+
+func TestKafkaQueueWriter_Headers(t *testing.T) {
+	q := NewKafkaQueueWriter("documents-out", nil)
+	env := &Envelope{Headers: []kafka.Header{
+		{Key: HeaderTraceID, Value: []byte("trace")},
+		{Key: HeaderSchemaVersion, Value: []byte("0")},
+		{Key: HeaderProducerHost, Value: []byte("upstream")},
+	}}
+
+	out := &Envelope{Headers: q.headers(env)}
+	for header, expected := range map[string]string{
+		HeaderTraceID:       "trace",
+		HeaderSchemaVersion: SchemaVersion,
+		HeaderProducerHost:  producerHost,
+	} {
+		value, _ := out.Header(header)
+		assert.Equal(t, expected, value, header)
+	}
+	assert.Len(t, out.Headers, 3)
+
+	out = &Envelope{Headers: q.headers(&Envelope{})}
+	_, ok := out.Header(HeaderTraceID)
+	assert.True(t, ok, "expected a new trace for a new message")
+}
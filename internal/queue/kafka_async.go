@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"vk/internal/retry"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// KafkaAsyncProducer enqueues messages into the librdkafka producer without
+// waiting for the broker to acknowledge them, so that they are sent in
+// batches. Delivery reports are collected on a background goroutine until
+// the producer is closed.
+//
+// A failed delivery is retried and then reported to the error handler, the
+// message stays pending meanwhile. A message the handler fails too is lost:
+// Lost is closed and every later Flush returns an error, so offsets of the
+// messages that were written should be committed only after a successful
+// Flush. The producer should be stopped once Lost is closed, as nothing can
+// be committed anymore.
+type KafkaAsyncProducer struct {
+	producer *kafka.Producer
+	retry    retry.Policy
+	onError  func(msg *kafka.Message, err error) error
+
+	mutex   sync.Mutex
+	pending int
+	// idle is closed once there are no pending messages
+	idle chan struct{}
+	// lost counts the messages that could not be delivered nor handled,
+	// err is the first of their errors
+	lost int
+	err  error
+	// lostCh is closed when the first message is lost
+	lostCh chan struct{}
+}
+
+type AsyncProducerOption func(*KafkaAsyncProducer)
+
+// WithDeliveryRetry sets how failed deliveries are retried, they are not
+// retried by default.
+func WithDeliveryRetry(policy retry.Policy) AsyncProducerOption {
+	return func(p *KafkaAsyncProducer) {
+		p.retry = policy
+	}
+}
+
+// WithDeliveryErrorHandler sets the function called for every message that
+// failed to be delivered once retries are exhausted, e.g. to dead-letter it.
+// If it returns nil, the failure is considered handled. By default every
+// failure is returned, so the message is lost.
+func WithDeliveryErrorHandler(fn func(msg *kafka.Message, err error) error) AsyncProducerOption {
+	return func(p *KafkaAsyncProducer) {
+		p.onError = fn
+	}
+}
+
+// NewKafkaAsyncProducer starts collecting delivery reports of the producer.
+// Messages produced with a delivery channel still report to that channel.
+func NewKafkaAsyncProducer(producer *kafka.Producer, opts ...AsyncProducerOption) *KafkaAsyncProducer {
+	idle := make(chan struct{})
+	close(idle)
+
+	p := &KafkaAsyncProducer{
+		producer: producer,
+		retry:    retry.Policy{MaxAttempts: 1},
+		onError: func(_ *kafka.Message, err error) error {
+			return err
+		},
+		idle:   idle,
+		lostCh: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	go p.run()
+	return p
+}
+
+// Produce enqueues the message. An error is returned only if the message
+// can't be enqueued, e.g. the local queue is full.
+func (p *KafkaAsyncProducer) Produce(msg *kafka.Message) error {
+	p.mutex.Lock()
+	if p.pending == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.pending++
+	p.mutex.Unlock()
+
+	if err := p.producer.Produce(msg, nil); err != nil {
+		p.delivered(nil)
+		return fmt.Errorf("failed to produce message: %w", err)
+	}
+	return nil
+}
+
+// Flush waits until all enqueued messages are delivered or handled and
+// returns an error if any message has been lost.
+func (p *KafkaAsyncProducer) Flush(ctx context.Context) error {
+	p.mutex.Lock()
+	idle := p.idle
+	p.mutex.Unlock()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.err != nil {
+		return fmt.Errorf("failed to deliver %d messages: %w", p.lost, p.err)
+	}
+	return nil
+}
+
+// Lost returns a channel closed once a message is lost.
+func (p *KafkaAsyncProducer) Lost() <-chan struct{} {
+	return p.lostCh
+}
+
+// run handles the producer events until the producer is closed.
+func (p *KafkaAsyncProducer) run() {
+	for e := range p.producer.Events() {
+		switch ev := e.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error != nil {
+				// the message stays pending until the failure is handled,
+				// so a Flush returns after the handler
+				go p.failed(ev)
+				continue
+			}
+			p.delivered(nil)
+		case kafka.Error:
+			log.Printf("Producer error: %v\n", ev)
+		}
+	}
+}
+
+// failed retries producing a message that failed to be delivered and hands
+// it to the error handler if retries do not help.
+func (p *KafkaAsyncProducer) failed(msg *kafka.Message) {
+	retryMsg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: msg.TopicPartition.Topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        msg.Headers,
+	}
+
+	// the first attempt is the failed delivery itself
+	attempt := 0
+	err := p.retry.Do(context.Background(), func(ctx context.Context) error {
+		attempt++
+		if attempt == 1 {
+			return msg.TopicPartition.Error
+		}
+		return produce(ctx, p.producer, retryMsg)
+	})
+	if err != nil {
+		err = p.onError(msg, err)
+	}
+	if err != nil {
+		log.Printf("Lost message to %v: %v\n", msg.TopicPartition, err)
+	}
+	p.delivered(err)
+}
+
+// delivered records the outcome of a pending message.
+func (p *KafkaAsyncProducer) delivered(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err != nil {
+		p.lost++
+		if p.err == nil {
+			p.err = err
+			close(p.lostCh)
+		}
+	}
+
+	p.pending--
+	if p.pending == 0 {
+		close(p.idle)
+	}
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"vk/internal/retry"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaAsyncProducer_FlushEmpty(t *testing.T) {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "localhost:1"})
+	require.NoError(t, err)
+	defer producer.Close()
+
+	async := NewKafkaAsyncProducer(producer)
+	assert.NoError(t, async.Flush(context.Background()), "expected nothing to flush")
+}
+
+// unreachableProducer returns a producer whose messages time out, nothing
+// listens on the port.
+func unreachableProducer(t *testing.T) *kafka.Producer {
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":  "localhost:1",
+		"message.timeout.ms": 100,
+	})
+	require.NoError(t, err)
+	t.Cleanup(producer.Close)
+	return producer
+}
+
+func produceValues(t *testing.T, async *KafkaAsyncProducer, values ...string) {
+	topic := "documents-out"
+	for _, value := range values {
+		err := async.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          []byte(value),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestKafkaAsyncProducer_DeliveryFailure(t *testing.T) {
+	var mutex sync.Mutex
+	var failed []string
+	async := NewKafkaAsyncProducer(unreachableProducer(t),
+		WithDeliveryRetry(retry.Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}),
+		WithDeliveryErrorHandler(func(msg *kafka.Message, err error) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			failed = append(failed, string(msg.Value))
+
+			var exhausted *retry.ExhaustedError
+			assert.ErrorAs(t, err, &exhausted)
+			assert.Equal(t, 2, exhausted.Attempts, "expected the delivery to be retried")
+			return nil
+		}))
+	produceValues(t, async, "first", "second")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	assert.NoError(t, async.Flush(ctx), "expected the handled failures not to be returned")
+
+	select {
+	case <-async.Lost():
+		t.Error("expected no message to be lost")
+	default:
+	}
+
+	mutex.Lock()
+	assert.ElementsMatch(t, []string{"first", "second"}, failed, "expected every failure to be handled")
+	mutex.Unlock()
+}
+
+func TestKafkaAsyncProducer_LostMessage(t *testing.T) {
+	async := NewKafkaAsyncProducer(unreachableProducer(t))
+	produceValues(t, async, "first", "second")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := async.Flush(ctx)
+	require.Error(t, err, "expected the lost messages to be returned")
+	assert.Contains(t, err.Error(), "failed to deliver 2 messages")
+
+	assert.Error(t, async.Flush(ctx), "expected every later Flush to fail")
+
+	select {
+	case <-async.Lost():
+	default:
+		t.Error("expected Lost to be closed")
+	}
+}
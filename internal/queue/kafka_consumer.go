@@ -0,0 +1,248 @@
+package queue
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// KafkaConsumer reads messages with auto-commit disabled and commits the
+// offset of a message only after it and all earlier messages of its partition
+// are done, so that a message is never committed before it is handled.
+type KafkaConsumer struct {
+	consumer committer
+	offsets  *OffsetTracker
+	// transactional is set when offsets are committed by KafkaTransactor
+	transactional bool
+	// onRevoke is called once revoked partitions are no longer owned and
+	// before they are handed over, nil by default
+	onRevoke func()
+
+	commitInterval time.Duration
+	lastCommit     time.Time
+	// beforeCommit is called before offsets are committed, nil by default
+	beforeCommit func() error
+
+	mutex sync.Mutex
+	// pending are the offsets ready to be committed
+	pending map[partition]kafka.TopicPartition
+	// generations count the revocations of every partition, in the
+	// transactional mode messages carry the generation they were read in
+	generations map[partition]int
+}
+
+// committer is the part of kafka.Consumer used by KafkaConsumer.
+type committer interface {
+	ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error)
+	Close() error
+}
+
+type ConsumerOption func(*KafkaConsumer)
+
+// WithCommitInterval sets how often done offsets are committed, 1s by default.
+func WithCommitInterval(interval time.Duration) ConsumerOption {
+	return func(c *KafkaConsumer) {
+		c.commitInterval = interval
+	}
+}
+
+// WithBeforeCommit sets a function called before done offsets are committed,
+// e.g. flushing asynchronously produced results. If it fails, the offsets
+// are kept and not committed.
+func WithBeforeCommit(fn func() error) ConsumerOption {
+	return func(c *KafkaConsumer) {
+		c.beforeCommit = fn
+	}
+}
+
+// WithTransactionalOffsets is used when offsets are committed together with
+// the results of each message by KafkaTransactor. Messages are then not
+// tracked and Done does nothing, instead Owns tells whether the partition of
+// a message has been revoked since the message was read.
+func WithTransactionalOffsets() ConsumerOption {
+	return func(c *KafkaConsumer) {
+		c.transactional = true
+	}
+}
+
+// NewKafkaConsumer creates a consumer subscribed to the topic. Auto-commit
+// settings of config are overridden.
+func NewKafkaConsumer(config *kafka.ConfigMap, topic string, opts ...ConsumerOption) (*KafkaConsumer, error) {
+	config.SetKey("enable.auto.commit", false)
+	config.SetKey("enable.auto.offset.store", false)
+
+	consumer, err := kafka.NewConsumer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newKafkaConsumer(consumer, opts...)
+	if err := consumer.Subscribe(topic, c.rebalance); err != nil {
+		consumer.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newKafkaConsumer(consumer committer, opts ...ConsumerOption) *KafkaConsumer {
+	c := &KafkaConsumer{
+		consumer:       consumer,
+		offsets:        NewOffsetTracker(),
+		commitInterval: time.Second,
+		lastCommit:     time.Now(),
+		pending:        make(map[partition]kafka.TopicPartition),
+		generations:    make(map[partition]int),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ReadMessage reads the next message and starts tracking it. Done offsets
+// are committed on the way once the commit interval has passed.
+func (c *KafkaConsumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	if time.Since(c.lastCommit) >= c.commitInterval {
+		c.lastCommit = time.Now()
+		if err := c.Commit(); err != nil {
+			log.Printf("Failed to commit offsets: %v\n", err)
+		}
+	}
+
+	msg, err := c.consumer.ReadMessage(timeout)
+	if err != nil {
+		return msg, err
+	}
+
+	if c.transactional {
+		c.mutex.Lock()
+		msg.Opaque = c.generations[partition{topic: *msg.TopicPartition.Topic, partition: msg.TopicPartition.Partition}]
+		c.mutex.Unlock()
+		return msg, nil
+	}
+
+	c.offsets.Start(msg.TopicPartition)
+	return msg, nil
+}
+
+// Owns reports whether the partition of a message read in the transactional
+// mode is still owned, i.e. it has not been revoked since the message was read.
+func (c *KafkaConsumer) Owns(msg *kafka.Message) bool {
+	generation, ok := msg.Opaque.(int)
+	if !ok {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generations[partition{topic: *msg.TopicPartition.Topic, partition: msg.TopicPartition.Partition}] == generation
+}
+
+// Done marks the message as handled. Its offset is committed once all
+// earlier messages of the partition are done too.
+func (c *KafkaConsumer) Done(msg *kafka.Message) {
+	commit, ok := c.offsets.Done(msg.TopicPartition)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pending[partition{topic: *commit.Topic, partition: commit.Partition}] = commit
+}
+
+// Commit synchronously commits the done offsets.
+func (c *KafkaConsumer) Commit() error {
+	return c.commit(func(partition) bool { return true })
+}
+
+func (c *KafkaConsumer) commit(filter func(partition) bool) error {
+	c.mutex.Lock()
+	var offsets []kafka.TopicPartition
+	for key, tp := range c.pending {
+		if filter(key) {
+			offsets = append(offsets, tp)
+			delete(c.pending, key)
+		}
+	}
+	c.mutex.Unlock()
+
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	// called after the offsets are taken, so that it covers every message
+	// done before them
+	var err error
+	if c.beforeCommit != nil {
+		err = c.beforeCommit()
+	}
+	if err == nil {
+		_, err = c.consumer.CommitOffsets(offsets)
+	}
+	if err != nil {
+		// keep the offsets for the next commit unless newer ones are done
+		c.mutex.Lock()
+		for _, tp := range offsets {
+			key := partition{topic: *tp.Topic, partition: tp.Partition}
+			if _, exists := c.pending[key]; !exists {
+				c.pending[key] = tp
+			}
+		}
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+// rebalance commits what is done in the revoked partitions before they are
+// handed over to another consumer. Messages read before are no longer owned,
+// onRevoke lets their in-flight transactions finish or abort first.
+func (c *KafkaConsumer) rebalance(_ *kafka.Consumer, e kafka.Event) error {
+	revoked, ok := e.(kafka.RevokedPartitions)
+	if !ok {
+		return nil
+	}
+
+	partitions := make(map[partition]bool)
+	c.mutex.Lock()
+	for _, tp := range revoked.Partitions {
+		key := partition{topic: *tp.Topic, partition: tp.Partition}
+		partitions[key] = true
+		c.generations[key]++
+	}
+	c.mutex.Unlock()
+
+	if c.onRevoke != nil {
+		c.onRevoke()
+	}
+
+	if err := c.commit(func(key partition) bool { return partitions[key] }); err != nil {
+		log.Printf("Failed to commit offsets of revoked partitions: %v\n", err)
+	}
+	c.offsets.Forget(revoked.Partitions)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range partitions {
+		delete(c.pending, key)
+	}
+	return nil
+}
+
+// GroupMetadata returns the consumer group metadata for
+// SendOffsetsToTransaction.
+func (c *KafkaConsumer) GroupMetadata() (*kafka.ConsumerGroupMetadata, error) {
+	return c.consumer.GetConsumerGroupMetadata()
+}
+
+// Close commits the done offsets and closes the consumer.
+func (c *KafkaConsumer) Close() error {
+	if err := c.Commit(); err != nil {
+		log.Printf("Failed to commit offsets: %v\n", err)
+	}
+	return c.consumer.Close()
+}
@@ -0,0 +1,253 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommitter returns the queued messages and records committed offsets.
+type fakeCommitter struct {
+	mutex     sync.Mutex
+	messages  []*kafka.Message
+	commits   [][]kafka.TopicPartition
+	commitErr error
+}
+
+func (f *fakeCommitter) ReadMessage(time.Duration) (*kafka.Message, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.messages) == 0 {
+		return nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+	}
+	msg := f.messages[0]
+	f.messages = f.messages[1:]
+	return msg, nil
+}
+
+func (f *fakeCommitter) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.commitErr != nil {
+		return nil, f.commitErr
+	}
+	f.commits = append(f.commits, offsets)
+	return offsets, nil
+}
+
+func (f *fakeCommitter) GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeCommitter) Close() error {
+	return nil
+}
+
+func testMessages(topic string, partition int32, offsets ...kafka.Offset) []*kafka.Message {
+	messages := make([]*kafka.Message, 0, len(offsets))
+	for _, offset := range offsets {
+		messages = append(messages, &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset},
+		})
+	}
+	return messages
+}
+
+func TestKafkaConsumer_TransactionalOffsets(t *testing.T) {
+	fake := &fakeCommitter{messages: testMessages("documents-in", 0, 1, 2, 3)}
+	c := newKafkaConsumer(fake, WithTransactionalOffsets())
+
+	for range 3 {
+		msg, err := c.ReadMessage(time.Millisecond)
+		require.NoError(t, err)
+		c.Done(msg)
+	}
+
+	assert.Empty(t, c.offsets.partitions, "expected no messages to be tracked")
+	require.NoError(t, c.Commit())
+	assert.Empty(t, fake.commits, "expected offsets to be left to the transactions")
+}
+
+func TestKafkaConsumer_Commit(t *testing.T) {
+	fake := &fakeCommitter{messages: testMessages("documents-in", 0, 10, 11, 12)}
+	c := newKafkaConsumer(fake, WithCommitInterval(time.Hour))
+
+	var messages []*kafka.Message
+	for range 3 {
+		msg, err := c.ReadMessage(time.Millisecond)
+		require.NoError(t, err)
+		messages = append(messages, msg)
+	}
+
+	c.Done(messages[1])
+	require.NoError(t, c.Commit())
+	assert.Empty(t, fake.commits, "expected no commit while an earlier message is in flight")
+
+	c.Done(messages[0])
+	require.NoError(t, c.Commit())
+	require.Len(t, fake.commits, 1)
+	assert.Equal(t, kafka.Offset(12), fake.commits[0][0].Offset, "expected to commit past the done messages")
+
+	require.NoError(t, c.Commit())
+	assert.Len(t, fake.commits, 1, "expected committed offsets not to be committed again")
+}
+
+func TestKafkaConsumer_CommitFailure(t *testing.T) {
+	fake := &fakeCommitter{messages: testMessages("documents-in", 0, 10)}
+	c := newKafkaConsumer(fake, WithCommitInterval(time.Hour))
+
+	msg, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	c.Done(msg)
+
+	fake.commitErr = errors.New("broker down")
+	assert.Error(t, c.Commit())
+
+	fake.commitErr = nil
+	require.NoError(t, c.Commit())
+	require.Len(t, fake.commits, 1, "expected the offset to be committed again")
+	assert.Equal(t, kafka.Offset(11), fake.commits[0][0].Offset)
+}
+
+func TestKafkaConsumer_BeforeCommit(t *testing.T) {
+	fake := &fakeCommitter{messages: testMessages("documents-in", 0, 10)}
+	flushErr := errors.New("not delivered")
+	c := newKafkaConsumer(fake, WithCommitInterval(time.Hour), WithBeforeCommit(func() error { return flushErr }))
+
+	require.NoError(t, c.Commit(), "expected nothing to flush without done offsets")
+
+	msg, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	c.Done(msg)
+
+	assert.ErrorIs(t, c.Commit(), flushErr)
+	assert.Empty(t, fake.commits, "expected no commit when the results are not flushed")
+
+	flushErr = nil
+	require.NoError(t, c.Commit())
+	require.Len(t, fake.commits, 1, "expected the kept offset to be committed")
+	assert.Equal(t, kafka.Offset(11), fake.commits[0][0].Offset)
+}
+
+func TestKafkaConsumer_CommitInterval(t *testing.T) {
+	fake := &fakeCommitter{messages: testMessages("documents-in", 0, 10, 11, 12)}
+	c := newKafkaConsumer(fake, WithCommitInterval(time.Hour))
+
+	msg, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	c.Done(msg)
+
+	_, err = c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, fake.commits, "expected no commit before the interval has passed")
+
+	c.lastCommit = time.Now().Add(-time.Hour)
+	_, err = c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	assert.Len(t, fake.commits, 1, "expected a commit once the interval has passed")
+}
+
+func TestKafkaConsumer_Rebalance(t *testing.T) {
+	topic := "documents-in"
+	fake := &fakeCommitter{messages: append(testMessages(topic, 0, 10, 11), testMessages(topic, 1, 5)...)}
+	c := newKafkaConsumer(fake, WithCommitInterval(time.Hour))
+
+	var messages []*kafka.Message
+	for range 3 {
+		msg, err := c.ReadMessage(time.Millisecond)
+		require.NoError(t, err)
+		messages = append(messages, msg)
+	}
+	c.Done(messages[0])
+	c.Done(messages[2])
+
+	revoked := kafka.RevokedPartitions{Partitions: []kafka.TopicPartition{{Topic: &topic, Partition: 0}}}
+	require.NoError(t, c.rebalance(nil, revoked))
+	require.Len(t, fake.commits, 1)
+	assert.Equal(t, []kafka.TopicPartition{{Topic: &topic, Partition: 0, Offset: 11}}, fake.commits[0],
+		"expected only the revoked partition to be committed")
+
+	c.Done(messages[1])
+	require.NoError(t, c.Commit())
+	require.Len(t, fake.commits, 2)
+	assert.Equal(t, []kafka.TopicPartition{{Topic: &topic, Partition: 1, Offset: 6}}, fake.commits[1],
+		"expected messages of the revoked partition to be forgotten")
+}
+
+func TestKafkaConsumer_RevokeTransactional(t *testing.T) {
+	topic := "documents-in"
+	fake := &fakeCommitter{messages: append(testMessages(topic, 0, 10), testMessages(topic, 1, 5)...)}
+	c := newKafkaConsumer(fake, WithTransactionalOffsets())
+
+	revokes := 0
+	c.onRevoke = func() { revokes++ }
+
+	stale, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	other, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, c.Owns(stale))
+
+	revoked := kafka.RevokedPartitions{Partitions: []kafka.TopicPartition{{Topic: &topic, Partition: 0}}}
+	require.NoError(t, c.rebalance(nil, revoked))
+	assert.Equal(t, 1, revokes)
+	assert.False(t, c.Owns(stale), "expected a message read before the revocation not to be owned")
+	assert.True(t, c.Owns(other), "expected other partitions to stay owned")
+
+	// the partition is assigned back
+	fake.messages = testMessages(topic, 0, 10)
+	fresh, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, c.Owns(fresh), "expected a message read after the revocation to be owned")
+	assert.False(t, c.Owns(stale))
+}
+
+func TestKafkaTransactor_Revoke(t *testing.T) {
+	topic := "documents-in"
+	fake := &fakeCommitter{messages: testMessages(topic, 0, 10)}
+	c := newKafkaConsumer(fake, WithTransactionalOffsets())
+	transactor := &KafkaTransactor{consumer: c}
+	c.onRevoke = transactor.drain
+
+	msg, err := c.ReadMessage(time.Millisecond)
+	require.NoError(t, err)
+
+	// a transaction is running
+	transactor.mutex.Lock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		revoked := kafka.RevokedPartitions{Partitions: []kafka.TopicPartition{{Topic: &topic, Partition: 0}}}
+		assert.NoError(t, c.rebalance(nil, revoked))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected the revocation to wait for the running transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	transactor.mutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the revocation to finish after the transaction")
+	}
+
+	called := false
+	err = transactor.Run(context.Background(), msg, func(context.Context) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrPartitionRevoked)
+	assert.False(t, called, "expected no transaction for a message of a revoked partition")
+}
@@ -0,0 +1,48 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Headers of a dead letter describing why and where the message failed.
+const (
+	HeaderDLQStage     = "dlq-stage"
+	HeaderDLQError     = "dlq-error"
+	HeaderDLQTopic     = "dlq-original-topic"
+	HeaderDLQPartition = "dlq-original-partition"
+	HeaderDLQOffset    = "dlq-original-offset"
+)
+
+// KafkaDeadLetterWriter publishes messages that could not be processed to
+// a dead-letter topic as they were read, with headers describing the failure.
+type KafkaDeadLetterWriter struct {
+	topic    string
+	producer *kafka.Producer
+}
+
+func NewKafkaDeadLetterWriter(topic string, producer *kafka.Producer) *KafkaDeadLetterWriter {
+	return &KafkaDeadLetterWriter{topic: topic, producer: producer}
+}
+
+func (q *KafkaDeadLetterWriter) WriteDeadLetter(ctx context.Context, msg *kafka.Message, stage string, cause error) error {
+	headers := append([]kafka.Header(nil), msg.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: HeaderDLQStage, Value: []byte(stage)},
+		kafka.Header{Key: HeaderDLQError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderDLQPartition, Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		kafka.Header{Key: HeaderDLQOffset, Value: []byte(strconv.FormatInt(int64(msg.TopicPartition.Offset), 10))},
+	)
+	if msg.TopicPartition.Topic != nil {
+		headers = append(headers, kafka.Header{Key: HeaderDLQTopic, Value: []byte(*msg.TopicPartition.Topic)})
+	}
+
+	return produce(ctx, q.producer, &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &q.topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        headers,
+	})
+}
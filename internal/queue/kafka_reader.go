@@ -1,22 +1,69 @@
 package queue
 
 import (
+	"context"
+	"fmt"
+
 	"vk/pkg/model"
 	"vk/pkg/proto"
 
-	gproto "google.golang.org/protobuf/proto"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
-type KafkaQueueReader struct{}
+type KafkaQueueReader struct {
+	codec Codec
+}
+
+type ReaderOption func(*KafkaQueueReader)
+
+// WithReaderCodec sets the codec of message values, protobuf by default.
+func WithReaderCodec(codec Codec) ReaderOption {
+	return func(q *KafkaQueueReader) {
+		q.codec = codec
+	}
+}
+
+func NewKafkaQueueReader(opts ...ReaderOption) *KafkaQueueReader {
+	q := &KafkaQueueReader{codec: ProtobufCodec{}}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// ReadEnvelope reads the document of the message together with its key,
+// headers and position. A message without a trace id starts a new trace.
+func (q *KafkaQueueReader) ReadEnvelope(ctx context.Context, msg *kafka.Message) (*Envelope, error) {
+	env := &Envelope{
+		Key:       msg.Key,
+		Headers:   append([]kafka.Header(nil), msg.Headers...),
+		Timestamp: msg.Timestamp,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    msg.TopicPartition.Offset,
+	}
+	if msg.TopicPartition.Topic != nil {
+		env.Topic = *msg.TopicPartition.Topic
+	}
+
+	if version, ok := env.Header(HeaderSchemaVersion); ok && version != SchemaVersion {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSchemaVersion, version)
+	}
+
+	doc, err := q.ReadDoc(ctx, env.Topic, msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	env.Document = doc
 
-func NewKafkaQueueReader() *KafkaQueueReader {
-	return &KafkaQueueReader{}
+	env.ensureTraceID()
+	return env, nil
 }
 
-func (q *KafkaQueueReader) ReadDoc(doc []byte) (*model.Document, error) {
+// ReadDoc decodes a message value read from the topic.
+func (q *KafkaQueueReader) ReadDoc(_ context.Context, topic string, doc []byte) (*model.Document, error) {
 	parsedDoc := &proto.TDocument{}
 
-	err := gproto.Unmarshal(doc, parsedDoc)
+	err := q.codec.Unmarshal(topic, doc, parsedDoc)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// ErrPartitionRevoked is returned for a message whose partition was revoked
+// after it had been read. Its transaction is aborted, the message is handled
+// by the new owner of the partition.
+var ErrPartitionRevoked = errors.New("partition revoked")
+
+// KafkaTransactor writes the results of a consumed message and commits its
+// offset in one Kafka transaction, so that downstream read_committed consumers
+// see the results of every message exactly once.
+//
+// A producer runs one transaction at a time, so transactions are serialized.
+// Offsets are committed message by message, messages of a partition must
+// therefore be handled in order. When partitions are revoked, the running
+// transaction finishes before they are handed over, and transactions of
+// messages read before are aborted.
+type KafkaTransactor struct {
+	mutex    sync.Mutex
+	producer *kafka.Producer
+	consumer *KafkaConsumer
+}
+
+// NewKafkaTransactor initializes transactions of a producer created with
+// "transactional.id". The consumer must be created WithTransactionalOffsets
+// and not read yet.
+func NewKafkaTransactor(ctx context.Context, producer *kafka.Producer, consumer *KafkaConsumer) (*KafkaTransactor, error) {
+	if err := producer.InitTransactions(ctx); err != nil {
+		return nil, err
+	}
+
+	t := &KafkaTransactor{producer: producer, consumer: consumer}
+	consumer.onRevoke = t.drain
+	return t, nil
+}
+
+// drain waits for the running transaction to finish.
+func (t *KafkaTransactor) drain() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+}
+
+// Run calls fn inside a transaction and commits the transaction together
+// with the offset of msg. Messages fn produces with the transactor producer
+// belong to the transaction. On error the transaction is aborted.
+func (t *KafkaTransactor) Run(ctx context.Context, msg *kafka.Message, fn func(ctx context.Context) error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.consumer.Owns(msg) {
+		return ErrPartitionRevoked
+	}
+
+	if err := t.producer.BeginTransaction(); err != nil {
+		return err
+	}
+
+	if err := t.commit(ctx, msg, fn); err != nil {
+		if abortErr := t.producer.AbortTransaction(context.WithoutCancel(ctx)); abortErr != nil {
+			log.Printf("Failed to abort transaction: %v\n", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *KafkaTransactor) commit(ctx context.Context, msg *kafka.Message, fn func(ctx context.Context) error) error {
+	if err := fn(ctx); err != nil {
+		return err
+	}
+
+	// the partition may be revoked while fn runs
+	if !t.consumer.Owns(msg) {
+		return ErrPartitionRevoked
+	}
+
+	metadata, err := t.consumer.GroupMetadata()
+	if err != nil {
+		return err
+	}
+
+	offset := msg.TopicPartition
+	offset.Offset++
+	if err := t.producer.SendOffsetsToTransaction(ctx, []kafka.TopicPartition{offset}, metadata); err != nil {
+		return err
+	}
+
+	return t.producer.CommitTransaction(ctx)
+}
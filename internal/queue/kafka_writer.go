@@ -1,55 +1,181 @@
 package queue
 
 import (
+	"context"
+	"fmt"
 	"log"
 
 	"vk/pkg/model"
 	"vk/pkg/proto"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	gproto "google.golang.org/protobuf/proto"
 )
 
+// KafkaQueueWriter writes messages keyed by the document url, so that all
+// messages of a document land on one partition and are read in order.
 type KafkaQueueWriter struct {
 	topic    string
 	producer *kafka.Producer
+	// async enqueues messages without waiting for delivery, nil waits
+	async *KafkaAsyncProducer
+	// normalizer brings keys to the canonical url, nil keeps the url as is
+	normalizer URLNormalizer
+	codec      Codec
 }
 
-func NewKafkaQueueWriter(topic string, producer *kafka.Producer) *KafkaQueueWriter {
-	return &KafkaQueueWriter{topic: topic, producer: producer}
+// URLNormalizer brings a document url to its canonical form.
+type URLNormalizer interface {
+	Normalize(url string) (string, error)
 }
 
-func (q *KafkaQueueWriter) WriteDoc(doc model.Document) error {
-	deliveryChan := make(chan kafka.Event)
+type WriterOption func(*KafkaQueueWriter)
 
+// WithAsyncProducer makes the writer enqueue messages into the async producer
+// instead of waiting for every message to be delivered. Delivery failures are
+// reported by the async producer.
+func WithAsyncProducer(async *KafkaAsyncProducer) WriterOption {
+	return func(q *KafkaQueueWriter) {
+		q.async = async
+	}
+}
+
+// WithKeyNormalizer keys messages by the canonical form of the document url,
+// for documents that are written before they are normalized. Urls that can't
+// be normalized are used as is.
+func WithKeyNormalizer(normalizer URLNormalizer) WriterOption {
+	return func(q *KafkaQueueWriter) {
+		q.normalizer = normalizer
+	}
+}
+
+// WithWriterCodec sets the codec of message values, protobuf by default.
+func WithWriterCodec(codec Codec) WriterOption {
+	return func(q *KafkaQueueWriter) {
+		q.codec = codec
+	}
+}
+
+func NewKafkaQueueWriter(topic string, producer *kafka.Producer, opts ...WriterOption) *KafkaQueueWriter {
+	q := &KafkaQueueWriter{topic: topic, producer: producer, codec: ProtobufCodec{}}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// WriteDoc writes the document as a new message that starts a new trace.
+func (q *KafkaQueueWriter) WriteDoc(ctx context.Context, doc model.Document) error {
+	return q.WriteEnvelope(ctx, &Envelope{Document: &doc})
+}
+
+// WriteEnvelope writes the document of env with the headers of env. The
+// message is keyed by env.Key, or by the document url if the key is empty.
+func (q *KafkaQueueWriter) WriteEnvelope(ctx context.Context, env *Envelope) error {
+	doc := env.Document
 	protoDoc := proto.TDocument{
 		Url:            doc.Url,
 		PubDate:        doc.PubDate,
 		Text:           doc.Text,
 		FetchTime:      doc.FetchTime,
 		FirstFetchTime: doc.FirstFetchTime,
+		Provenance:     doc.Provenance,
+		OriginalUrl:    doc.OriginalUrl,
+	}
+
+	buf, err := q.codec.Marshal(q.topic, &protoDoc)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	key := env.Key
+	if len(key) == 0 {
+		key = q.key(doc.Url)
+	}
+	return q.write(ctx, key, q.headers(env), buf)
+}
+
+// WriteChange writes the change of the document of env with the headers of
+// env.
+func (q *KafkaQueueWriter) WriteChange(ctx context.Context, env *Envelope, change model.DocumentChange) error {
+	protoChange := proto.TDocumentChange{
+		Url:       change.Url,
+		FetchTime: change.FetchTime,
+		Version:   change.Version,
+		New:       change.New,
+		TextDiff:  change.TextDiff,
+	}
+	for _, field := range change.Fields {
+		protoChange.Fields = append(protoChange.Fields, &proto.TFieldChange{
+			Field:    field.Field,
+			OldValue: field.OldValue,
+			NewValue: field.NewValue,
+		})
+	}
+
+	buf, err := q.codec.Marshal(q.topic, &protoChange)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
 	}
 
-	buf, _ := gproto.Marshal(&protoDoc)
+	return q.write(ctx, q.key(change.Url), q.headers(env), buf)
+}
+
+// headers returns the headers of env stamped with the schema version, this
+// producer host and a trace id if env has none.
+func (q *KafkaQueueWriter) headers(env *Envelope) []kafka.Header {
+	out := &Envelope{Headers: append([]kafka.Header(nil), env.Headers...)}
+	out.ensureTraceID()
+	out.SetHeader(HeaderSchemaVersion, SchemaVersion)
+	out.SetHeader(HeaderProducerHost, producerHost)
+	return out.Headers
+}
 
-	err := q.producer.Produce(&kafka.Message{
+func (q *KafkaQueueWriter) key(url string) []byte {
+	if q.normalizer != nil {
+		if canonical, err := q.normalizer.Normalize(url); err == nil {
+			return []byte(canonical)
+		}
+	}
+	return []byte(url)
+}
+
+func (q *KafkaQueueWriter) write(ctx context.Context, key []byte, headers []kafka.Header, value []byte) error {
+	// the partition is picked by key with the "partitioner" producer setting
+	msg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &q.topic, Partition: kafka.PartitionAny},
-		Value:          buf,
-	}, deliveryChan)
+		Key:            key,
+		Value:          value,
+		Headers:        headers,
+	}
+	if q.async != nil {
+		return q.async.Produce(msg)
+	}
+	return produce(ctx, q.producer, msg)
+}
+
+// produce sends the message and waits for its delivery report.
+func produce(ctx context.Context, producer *kafka.Producer, msg *kafka.Message) error {
+	// Buffered so that a late delivery report never blocks the producer
+	// after the caller has given up waiting.
+	deliveryChan := make(chan kafka.Event, 1)
+
+	err := producer.Produce(msg, deliveryChan)
 	if err != nil {
-		log.Fatalf("Failed to produce message: %v\n", err)
-		return err
+		return fmt.Errorf("failed to produce message: %w", err)
 	}
 
-	e := <-deliveryChan
+	var e kafka.Event
+	select {
+	case e = <-deliveryChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	m := e.(*kafka.Message)
 
 	if m.TopicPartition.Error != nil {
-		log.Fatalf("Failed to deliver message: %v\n", m.TopicPartition.Error)
-	} else {
-		log.Printf("Produced message to %v[%d] at offset %v\n", *m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
+		return fmt.Errorf("failed to deliver message: %w", m.TopicPartition.Error)
 	}
 
-	close(deliveryChan)
+	log.Printf("Produced message to %v[%d] at offset %v\n", *m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
 	return nil
 }
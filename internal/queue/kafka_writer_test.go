@@ -0,0 +1,21 @@
+package queue
+
+import (
+	"testing"
+
+	"vk/pkg/urlnorm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaQueueWriter_Key(t *testing.T) {
+	q := NewKafkaQueueWriter("documents-in", nil)
+	assert.Equal(t, []byte("HTTP://Example.com:80/doc?utm_source=x"), q.key("HTTP://Example.com:80/doc?utm_source=x"),
+		"expected the url as is without a normalizer")
+
+	q = NewKafkaQueueWriter("documents-in", nil, WithKeyNormalizer(urlnorm.New()))
+	assert.Equal(t, []byte("http://example.com/doc"), q.key("HTTP://Example.com:80/doc?utm_source=x"),
+		"expected the canonical url")
+	assert.Equal(t, []byte("http://[::1"), q.key("http://[::1"),
+		"expected a url that can't be normalized as is")
+}
@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+type partition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets keeps the offsets of a partition that are being processed,
+// in the order they were read.
+type partitionOffsets struct {
+	inFlight []kafka.Offset
+	done     map[kafka.Offset]bool
+}
+
+// OffsetTracker finds the offsets that are safe to commit when messages are
+// processed out of order: the offset of a partition moves only past messages
+// that are done together with all earlier messages of the partition.
+type OffsetTracker struct {
+	mutex      sync.Mutex
+	partitions map[partition]*partitionOffsets
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{partitions: make(map[partition]*partitionOffsets)}
+}
+
+// Start registers a read message. Messages of a partition must be started in
+// the order they were read.
+func (t *OffsetTracker) Start(tp kafka.TopicPartition) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := partition{topic: *tp.Topic, partition: tp.Partition}
+	offsets, exists := t.partitions[key]
+	if !exists {
+		offsets = &partitionOffsets{done: make(map[kafka.Offset]bool)}
+		t.partitions[key] = offsets
+	}
+	offsets.inFlight = append(offsets.inFlight, tp.Offset)
+}
+
+// Done marks a message as processed. If all earlier messages of the partition
+// are done too, it returns the offset to commit: the offset of the next
+// message to read.
+func (t *OffsetTracker) Done(tp kafka.TopicPartition) (kafka.TopicPartition, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	offsets, exists := t.partitions[partition{topic: *tp.Topic, partition: tp.Partition}]
+	if !exists {
+		return kafka.TopicPartition{}, false
+	}
+	// a message read before the partition was revoked and assigned again
+	// may be outside of the messages in flight, it would never be cleared
+	if len(offsets.inFlight) == 0 || tp.Offset < offsets.inFlight[0] || tp.Offset > offsets.inFlight[len(offsets.inFlight)-1] {
+		return kafka.TopicPartition{}, false
+	}
+	offsets.done[tp.Offset] = true
+
+	committed := false
+	commit := tp
+	for len(offsets.inFlight) > 0 && offsets.done[offsets.inFlight[0]] {
+		delete(offsets.done, offsets.inFlight[0])
+		commit.Offset = offsets.inFlight[0] + 1
+		offsets.inFlight = offsets.inFlight[1:]
+		committed = true
+	}
+	return commit, committed
+}
+
+// Forget drops the messages of the partitions, e.g. when they are revoked
+// from the consumer. Their later Done calls are ignored, also once the
+// partition is started again, unless the offset is read again.
+func (t *OffsetTracker) Forget(partitions []kafka.TopicPartition) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, tp := range partitions {
+		delete(t.partitions, partition{topic: *tp.Topic, partition: tp.Partition})
+	}
+}
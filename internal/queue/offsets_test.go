@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	topic := "documents-in"
+	message := func(partition int32, offset kafka.Offset) kafka.TopicPartition {
+		return kafka.TopicPartition{Topic: &topic, Partition: partition, Offset: offset}
+	}
+
+	tracker := NewOffsetTracker()
+	for offset := kafka.Offset(10); offset < 14; offset++ {
+		tracker.Start(message(0, offset))
+	}
+	tracker.Start(message(1, 5))
+
+	_, ok := tracker.Done(message(0, 11))
+	assert.False(t, ok, "expected no commit while an earlier message is in flight")
+
+	_, ok = tracker.Done(message(0, 13))
+	assert.False(t, ok, "expected no commit while an earlier message is in flight")
+
+	commit, ok := tracker.Done(message(0, 10))
+	assert.True(t, ok, "expected a commit once the first message is done")
+	assert.Equal(t, message(0, 12), commit, "expected to commit past the contiguous done messages")
+
+	commit, ok = tracker.Done(message(1, 5))
+	assert.True(t, ok, "expected partitions to be tracked independently")
+	assert.Equal(t, message(1, 6), commit)
+
+	commit, ok = tracker.Done(message(0, 12))
+	assert.True(t, ok, "expected a commit once the gap is done")
+	assert.Equal(t, message(0, 14), commit)
+
+	tracker.Start(message(0, 14))
+	tracker.Forget([]kafka.TopicPartition{message(0, kafka.OffsetInvalid)})
+
+	_, ok = tracker.Done(message(0, 14))
+	assert.False(t, ok, "expected messages of a revoked partition to be ignored")
+
+	// the partition is assigned again from the committed offset
+	tracker.Start(message(0, 12))
+	tracker.Start(message(0, 13))
+
+	_, ok = tracker.Done(message(0, 11))
+	assert.False(t, ok, "expected a message read before the revocation to be ignored")
+	_, ok = tracker.Done(message(0, 14))
+	assert.False(t, ok, "expected a message read before the revocation to be ignored")
+	assert.Empty(t, tracker.partitions[partition{topic: topic, partition: 0}].done, "expected no offsets outside of the messages in flight to be kept")
+
+	tracker.Done(message(0, 13))
+	commit, ok = tracker.Done(message(0, 12))
+	assert.True(t, ok)
+	assert.Equal(t, message(0, 14), commit)
+}
@@ -1,7 +1,14 @@
 package queue
 
-import "vk/pkg/model"
+import (
+	"context"
+
+	"vk/pkg/model"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
 
 type QueueReader interface {
-	ReadDoc(doc []byte) (*model.Document, error)
+	ReadEnvelope(ctx context.Context, msg *kafka.Message) (*Envelope, error)
+	ReadDoc(ctx context.Context, topic string, doc []byte) (*model.Document, error)
 }
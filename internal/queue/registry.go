@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileRegistry is a schema registry stand-in backed by a JSON file mapping
+// subjects to schema ids. As in a schema registry, subjects with the same
+// schema may share its id:
+//
+//	{"documents-in-value": 1, "documents-out-value": 1, "documents-changes-value": 2}
+type FileRegistry struct {
+	ids      map[string]int32
+	subjects map[int32][]string
+}
+
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids map[string]int32
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("can't parse schema registry %s: %w", path, err)
+	}
+
+	r := &FileRegistry{ids: ids, subjects: make(map[int32][]string, len(ids))}
+	for subject, id := range ids {
+		r.subjects[id] = append(r.subjects[id], subject)
+	}
+	return r, nil
+}
+
+func (r *FileRegistry) SchemaID(subject string) (int32, error) {
+	id, ok := r.ids[subject]
+	if !ok {
+		return 0, fmt.Errorf("%w: no schema for subject %s", ErrUnknownSchema, subject)
+	}
+	return id, nil
+}
+
+func (r *FileRegistry) Subjects(id int32) ([]string, error) {
+	subjects, ok := r.subjects[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSchema, id)
+	}
+	return subjects, nil
+}
@@ -1,7 +1,22 @@
 package queue
 
-import "vk/pkg/model"
+import (
+	"context"
+
+	"vk/pkg/model"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
 
 type QueueWriter interface {
-	WriteDoc(doc model.Document) error
+	WriteEnvelope(ctx context.Context, env *Envelope) error
+	WriteDoc(ctx context.Context, doc model.Document) error
+}
+
+type ChangeWriter interface {
+	WriteChange(ctx context.Context, env *Envelope, change model.DocumentChange) error
+}
+
+type DeadLetterWriter interface {
+	WriteDeadLetter(ctx context.Context, msg *kafka.Message, stage string, cause error) error
 }
@@ -0,0 +1,73 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"vk/pkg/repository"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/lib/pq"
+)
+
+// retryablePostgresClasses are SQLSTATE classes of transient PostgreSQL errors:
+// connection exceptions, transaction rollbacks (serialization failures,
+// deadlocks), insufficient resources and operator intervention (shutdowns).
+var retryablePostgresClasses = []string{"08", "40", "53", "57P"}
+
+var retryableKafkaCodes = map[kafka.ErrorCode]bool{
+	kafka.ErrTransport:             true,
+	kafka.ErrMsgTimedOut:           true,
+	kafka.ErrAllBrokersDown:        true,
+	kafka.ErrQueueFull:             true,
+	kafka.ErrTimedOut:              true,
+	kafka.ErrLeaderNotAvailable:    true,
+	kafka.ErrNotLeaderForPartition: true,
+	kafka.ErrRequestTimedOut:       true,
+	kafka.ErrNetworkException:      true,
+	kafka.ErrNotEnoughReplicas:     true,
+}
+
+// IsRetryable classifies an error as transient: network and connection
+// failures, transient PostgreSQL and Kafka errors and busy document locks.
+// Everything else is permanent, including version conflicts: the processor
+// retries them PROCESSOR_MAX_RETRIES times itself.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, repository.ErrVersionConflict) {
+		return false
+	}
+	if errors.Is(err, repository.ErrLockTimeout) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		for _, class := range retryablePostgresClasses {
+			if strings.HasPrefix(string(pqErr.Code), class) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return !kafkaErr.IsFatal() && (kafkaErr.IsRetriable() || retryableKafkaCodes[kafkaErr.Code()])
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
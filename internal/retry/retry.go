@@ -0,0 +1,85 @@
+// Package retry runs operations again after transient failures.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Policy describes how many times and how often an operation is retried.
+type Policy struct {
+	// MaxAttempts is the number of calls including the first one.
+	MaxAttempts int
+	// InitialBackoff is the wait before the second call. Every next wait is
+	// Multiplier times longer, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction of every wait that is randomized, from 0 to 1.
+	Jitter float64
+	// Retryable reports whether an error is transient. Nil means IsRetryable.
+	Retryable func(err error) bool
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:    5,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// ExhaustedError is returned when every attempt failed with a retryable error.
+type ExhaustedError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("%d attempts failed: %v", e.Attempts, e.Err)
+}
+
+func (e *ExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// Do calls fn until it succeeds, fails with a permanent error or the attempts
+// are exhausted. A permanent error is returned as is.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			return &ExhaustedError{Attempts: attempt, Err: err}
+		}
+
+		wait := time.NewTimer(p.jitter(backoff))
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return errors.Join(err, ctx.Err())
+		}
+
+		backoff = min(time.Duration(float64(backoff)*p.Multiplier), p.MaxBackoff)
+	}
+}
+
+func (p Policy) jitter(backoff time.Duration) time.Duration {
+	random := time.Duration(float64(backoff) * p.Jitter)
+	if random <= 0 {
+		return backoff
+	}
+	return backoff - random + rand.N(random+1)
+}
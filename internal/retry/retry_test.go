@@ -0,0 +1,127 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"vk/pkg/repository"
+	"vk/pkg/validator"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var errTransient = errors.New("transient")
+
+func testPolicy() Policy {
+	return Policy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Multiplier:     2,
+		Jitter:         0.5,
+		Retryable:      func(err error) bool { return errors.Is(err, errTransient) },
+	}
+}
+
+func TestPolicy_Do(t *testing.T) {
+	t.Run("RetryTransient", func(t *testing.T) {
+		calls := 0
+		err := testPolicy().Do(context.Background(), func(context.Context) error {
+			calls++
+			if calls < 3 {
+				return errTransient
+			}
+			return nil
+		})
+		assert.NoError(t, err, "expected the last attempt to succeed")
+		assert.Equal(t, 3, calls, "expected a call per attempt")
+	})
+
+	t.Run("Permanent", func(t *testing.T) {
+		permanent := errors.New("permanent")
+
+		calls := 0
+		err := testPolicy().Do(context.Background(), func(context.Context) error {
+			calls++
+			return permanent
+		})
+		assert.Equal(t, permanent, err, "expected the permanent error as is")
+		assert.Equal(t, 1, calls, "expected no retries of a permanent error")
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		calls := 0
+		err := testPolicy().Do(context.Background(), func(context.Context) error {
+			calls++
+			return errTransient
+		})
+
+		var exhausted *ExhaustedError
+		assert.ErrorAs(t, err, &exhausted, "expected exhausted retries")
+		assert.Equal(t, 3, exhausted.Attempts)
+		assert.ErrorIs(t, err, errTransient, "expected the last error to be wrapped")
+		assert.Equal(t, 3, calls, "expected MaxAttempts calls")
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		policy := testPolicy()
+		policy.InitialBackoff = time.Hour
+		policy.MaxBackoff = time.Hour
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		err := policy.Do(ctx, func(context.Context) error {
+			return errTransient
+		})
+		assert.ErrorIs(t, err, context.Canceled, "expected the wait to be cancelled")
+		assert.ErrorIs(t, err, errTransient, "expected the last error to be kept")
+	})
+}
+
+func TestPolicy_Jitter(t *testing.T) {
+	policy := Policy{Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		wait := policy.jitter(100 * time.Millisecond)
+		assert.GreaterOrEqual(t, wait, 50*time.Millisecond)
+		assert.LessOrEqual(t, wait, 100*time.Millisecond)
+	}
+
+	assert.Equal(t, 100*time.Millisecond, Policy{}.jitter(100*time.Millisecond), "expected no jitter")
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"ConnectionFailure", &pq.Error{Code: "08006"}, true},
+		{"SerializationFailure", fmt.Errorf("can't save: %w", &pq.Error{Code: "40001"}), true},
+		{"Deadlock", &pq.Error{Code: "40P01"}, true},
+		{"AdminShutdown", &pq.Error{Code: "57P01"}, true},
+		{"UniqueViolation", &pq.Error{Code: "23505"}, false},
+		{"BadConn", driver.ErrBadConn, true},
+		{"KafkaTransport", kafka.NewError(kafka.ErrTransport, "transport", false), true},
+		{"KafkaMsgTimedOut", fmt.Errorf("failed to deliver message: %w", kafka.NewError(kafka.ErrMsgTimedOut, "timed out", false)), true},
+		{"KafkaFatal", kafka.NewError(kafka.ErrTransport, "fatal", true), false},
+		{"KafkaMsgSizeTooLarge", kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false), false},
+		{"LockTimeout", repository.ErrLockTimeout, true},
+		{"VersionConflict", &repository.VersionConflictError{Url: "http://example.com"}, false},
+		{"Validation", &validator.ValidationError{Reason: validator.ErrEmptyURL}, false},
+		{"Cancelled", context.Canceled, false},
+		{"Unknown", errors.New("unknown"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsRetryable(tt.err))
+		})
+	}
+}
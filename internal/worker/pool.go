@@ -0,0 +1,85 @@
+// Package worker runs tasks concurrently while keeping the order of tasks
+// with the same key.
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("worker pool is closed")
+
+// Pool runs tasks on a fixed set of workers. Tasks are hashed by key to
+// workers, so tasks with the same key run one at a time in submission order.
+type Pool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// NewPool starts workerCount workers, each with a queue of queueSize tasks.
+func NewPool(workerCount, queueSize int) *Pool {
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	p := &Pool{queues: make([]chan func(), workerCount)}
+	for idx := range p.queues {
+		queue := make(chan func(), queueSize)
+		p.queues[idx] = queue
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues the task to the worker of the key. It blocks while the
+// worker queue is full.
+func (p *Pool) Submit(ctx context.Context, key string, task func()) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case p.queue(key) <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) queue(key string) chan func() {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per call
+	hash := uint32(2166136261)
+	for idx := 0; idx < len(key); idx++ {
+		hash ^= uint32(key[idx])
+		hash *= 16777619
+	}
+	return p.queues[hash%uint32(len(p.queues))]
+}
+
+// Close stops accepting tasks and waits for the queued ones to finish.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+}
@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_KeyOrder(t *testing.T) {
+	pool := NewPool(4, 10)
+
+	keysCount := 8
+	tasksCount := 100
+
+	var mutex sync.Mutex
+	done := make(map[string][]int)
+
+	for idx := 0; idx < tasksCount; idx++ {
+		for key := 0; key < keysCount; key++ {
+			key := fmt.Sprintf("http://example.com/%d", key)
+			err := pool.Submit(context.Background(), key, func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				done[key] = append(done[key], idx)
+			})
+			assert.NoError(t, err, "expected no error submitting task")
+		}
+	}
+
+	pool.Close()
+
+	assert.Len(t, done, keysCount, "expected tasks of every key to run")
+	for key, tasks := range done {
+		assert.Len(t, tasks, tasksCount, "expected every task of %s to run", key)
+		assert.IsIncreasing(t, tasks, "expected tasks of %s to run in submission order", key)
+	}
+}
+
+func TestPool_Concurrency(t *testing.T) {
+	workersCount := 4
+	pool := NewPool(workersCount, 0)
+
+	var running, maxRunning atomic.Int32
+	for key := 0; key < 32; key++ {
+		err := pool.Submit(context.Background(), fmt.Sprint(key), func() {
+			current := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				seen := maxRunning.Load()
+				if current <= seen || maxRunning.CompareAndSwap(seen, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		})
+		assert.NoError(t, err, "expected no error submitting task")
+	}
+
+	pool.Close()
+
+	assert.Greater(t, maxRunning.Load(), int32(1), "expected tasks of different keys to run concurrently")
+	assert.LessOrEqual(t, maxRunning.Load(), int32(workersCount), "expected at most one task per worker")
+}
+
+func TestPool_Submit(t *testing.T) {
+	pool := NewPool(1, 0)
+
+	release := make(chan struct{})
+	err := pool.Submit(context.Background(), "key", func() { <-release })
+	assert.NoError(t, err, "expected no error submitting task")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = pool.Submit(ctx, "key", func() {})
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected submit to a busy worker to wait")
+
+	close(release)
+	pool.Close()
+
+	err = pool.Submit(context.Background(), "key", func() {})
+	assert.ErrorIs(t, err, ErrPoolClosed, "expected error submitting to a closed pool")
+}
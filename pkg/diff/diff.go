@@ -0,0 +1,218 @@
+// Package diff builds line-based unified diffs of document texts.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Context is the number of unchanged lines around every change in a hunk.
+const Context = 3
+
+// MaxLines and MaxEdits bound the time and memory of a diff: texts with more
+// lines in total, or that differ in more lines, are not diffed.
+const (
+	MaxLines = 100000
+	MaxEdits = 1000
+)
+
+// Replaced follows the headers instead of hunks when the texts are not diffed.
+const Replaced = "text replaced, too many lines to diff\n"
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+// edit is a step of the edit script. a and b are line positions in the old
+// and new text; the line itself is a[a] for opEqual and opDelete, b[b] for
+// opInsert.
+type edit struct {
+	kind opKind
+	a, b int
+}
+
+// Unified returns the diff of oldText and newText in unified format, or an
+// empty string when the texts are equal. Texts over MaxLines or MaxEdits get
+// the Replaced line instead of hunks.
+func Unified(oldLabel, newLabel, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldLabel, newLabel)
+
+	a, b := splitLines(oldText), splitLines(newText)
+	if len(a)+len(b) > MaxLines {
+		sb.WriteString(Replaced)
+		return sb.String()
+	}
+
+	edits, ok := myers(a, b)
+	if !ok {
+		sb.WriteString(Replaced)
+		return sb.String()
+	}
+
+	for start := 0; start < len(edits); {
+		if edits[start].kind == opEqual {
+			start++
+			continue
+		}
+
+		// extend the hunk while the next change is close enough to share context
+		end := start + 1
+		for equal := 0; end < len(edits) && equal <= 2*Context; end++ {
+			if edits[end].kind == opEqual {
+				equal++
+			} else {
+				equal = 0
+			}
+		}
+		for end > start && edits[end-1].kind == opEqual {
+			end--
+		}
+
+		writeHunk(&sb, a, b, edits[max(0, start-Context):min(len(edits), end+Context)])
+		start = end
+	}
+
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, a, b []string, edits []edit) {
+	var aCount, bCount int
+	for _, e := range edits {
+		if e.kind != opInsert {
+			aCount++
+		}
+		if e.kind != opDelete {
+			bCount++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(edits[0].a, aCount), hunkRange(edits[0].b, bCount))
+
+	for _, e := range edits {
+		switch e.kind {
+		case opEqual:
+			writeLine(sb, ' ', a[e.a])
+		case opDelete:
+			writeLine(sb, '-', a[e.a])
+		case opInsert:
+			writeLine(sb, '+', b[e.b])
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
+
+func writeLine(sb *strings.Builder, prefix byte, line string) {
+	sb.WriteByte(prefix)
+	sb.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		sb.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// myers finds the shortest edit script turning a into b with the Myers
+// O(ND) algorithm. It gives up when the script is longer than MaxEdits.
+func myers(a, b []string) ([]edit, bool) {
+	n, m := len(a), len(b)
+	maxD := min(n+m, MaxEdits)
+	offset := maxD + 1
+	v := make([]int, 2*offset+1)
+
+	// trace[d] holds the furthest reaching paths after d-1 steps on the
+	// diagonals -(d-1)..d-1, the only ones step d reads
+	var trace [][]int
+	found := false
+search:
+	for d := 0; d <= maxD; d++ {
+		if d == 0 {
+			trace = append(trace, nil)
+		} else {
+			trace = append(trace, append([]int(nil), v[offset-d+1:offset+d]...))
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break search
+			}
+		}
+	}
+	if !found {
+		return nil, false
+	}
+
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		// diagonal k of step d-1 is at trace[d][k+d-1]
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d-1] < v[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d-1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{kind: opEqual, a: x, b: y})
+		}
+		if x == prevX {
+			edits = append(edits, edit{kind: opInsert, a: x, b: y - 1})
+		} else {
+			edits = append(edits, edit{kind: opDelete, a: x - 1, b: y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, edit{kind: opEqual, a: x, b: y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits, true
+}
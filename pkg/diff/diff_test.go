@@ -0,0 +1,95 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func numbers(replace map[string]string) string {
+	var sb strings.Builder
+	for _, line := range strings.Fields("1 2 3 4 5 6 7 8 9 10 11 12") {
+		if r, ok := replace[line]; ok {
+			line = r
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldText  string
+		newText  string
+		expected string
+	}{
+		{
+			name:     "Equal",
+			oldText:  "one\ntwo\n",
+			newText:  "one\ntwo\n",
+			expected: "",
+		},
+		{
+			name:    "ChangedLine",
+			oldText: "one\ntwo\nthree\n",
+			newText: "one\n2\nthree\n",
+			expected: "--- previous\n+++ current\n" +
+				"@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n",
+		},
+		{
+			name:    "SeparateHunks",
+			oldText: numbers(nil),
+			newText: numbers(map[string]string{"2": "two", "11": "eleven"}),
+			expected: "--- previous\n+++ current\n" +
+				"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+				"@@ -8,5 +8,5 @@\n 8\n 9\n 10\n-11\n+eleven\n 12\n",
+		},
+		{
+			name:    "NoNewlineAtEnd",
+			oldText: "a\nb",
+			newText: "a\nb\nc\n",
+			expected: "--- previous\n+++ current\n" +
+				"@@ -1,2 +1,3 @@\n a\n-b\n\\ No newline at end of file\n+b\n+c\n",
+		},
+		{
+			name:    "EmptyOld",
+			oldText: "",
+			newText: "x\n",
+			expected: "--- previous\n+++ current\n" +
+				"@@ -0,0 +1 @@\n+x\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Unified("previous", "current", tt.oldText, tt.newText))
+		})
+	}
+}
+
+func lines(prefix string, count int) string {
+	var sb strings.Builder
+	for i := range count {
+		fmt.Fprintf(&sb, "%s %d\n", prefix, i)
+	}
+	return sb.String()
+}
+
+func TestUnified_Limits(t *testing.T) {
+	header := "--- previous\n+++ current\n"
+
+	rewritten := Unified("previous", "current", lines("old", 3000), lines("new", 3000))
+	assert.Equal(t, header+Replaced, rewritten, "expected a full rewrite over MaxEdits not to be diffed")
+
+	long := lines("line", MaxLines)
+	assert.Equal(t, header+Replaced, Unified("previous", "current", long, long+"tail\n"), "expected texts over MaxLines not to be diffed")
+
+	oldText := lines("old", MaxEdits/2) + lines("same", 1000)
+	newText := lines("new", MaxEdits/2) + lines("same", 1000)
+	diff := Unified("previous", "current", oldText, newText)
+	assert.Equal(t, 1, strings.Count(diff, "@@ -"), "expected changes within MaxEdits to be diffed")
+	assert.Equal(t, MaxEdits/2, strings.Count(diff, "\n+new "))
+}
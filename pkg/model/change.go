@@ -0,0 +1,22 @@
+package model
+
+// DocumentChange describes how a message changed a stored document.
+type DocumentChange struct {
+	Url string
+	// FetchTime of the message that caused the change.
+	FetchTime uint64
+	Version   uint64
+	New       bool
+	Fields    []FieldChange
+	// TextDiff is a unified diff of Text, empty when Text did not change.
+	// Texts too large to diff get diff.Replaced instead of hunks.
+	TextDiff string
+}
+
+// FieldChange holds the previous and the new value of a changed field.
+// Numeric values are written in decimal.
+type FieldChange struct {
+	Field    string
+	OldValue string
+	NewValue string
+}
@@ -1,9 +1,77 @@
 package model
 
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"maps"
+)
+
+const (
+	FieldText    = "Text"
+	FieldPubDate = "PubDate"
+)
+
 type Document struct {
-	Url            string `db:"url"`
-	PubDate        uint64 `db:"pub_date" `
-	FetchTime      uint64 `db:"fetch_time"`
-	Text           string `db:"text"`
-	FirstFetchTime uint64 `db:"first_fetch_time"`
+	Url            string     `db:"url"`
+	PubDate        uint64     `db:"pub_date" `
+	FetchTime      uint64     `db:"fetch_time"`
+	Text           string     `db:"text"`
+	FirstFetchTime uint64     `db:"first_fetch_time"`
+	Version        uint64     `db:"version"`
+	Provenance     Provenance `db:"provenance"`
+	OriginalUrl    string     `db:"original_url"`
+}
+
+// Copy returns a deep copy of the document.
+func (d *Document) Copy() *Document {
+	doc := *d
+	doc.Provenance = d.Provenance.Copy()
+	return &doc
+}
+
+// Provenance maps a document field name to the FetchTime of the message that
+// last set the field. It is stored as a JSON object.
+type Provenance map[string]uint64
+
+func (p Provenance) Copy() Provenance {
+	if len(p) == 0 {
+		return nil
+	}
+	return maps.Clone(p)
+}
+
+func (p Provenance) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// Scan reads a JSON object. An empty object is read as nil.
+func (p *Provenance) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*p = nil
+		return nil
+	default:
+		return errors.New("unsupported provenance type")
+	}
+
+	var provenance Provenance
+	if err := json.Unmarshal(data, &provenance); err != nil {
+		return err
+	}
+	*p = provenance.Copy()
+	return nil
 }
@@ -25,11 +25,15 @@ type TDocument struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Url            string `protobuf:"bytes,1,opt,name=Url,proto3" json:"Url,omitempty"`
-	PubDate        uint64 `protobuf:"varint,2,opt,name=PubDate,proto3" json:"PubDate,omitempty"`
-	FetchTime      uint64 `protobuf:"varint,3,opt,name=FetchTime,proto3" json:"FetchTime,omitempty"`
-	Text           string `protobuf:"bytes,4,opt,name=Text,proto3" json:"Text,omitempty"`
-	FirstFetchTime uint64 `protobuf:"varint,5,opt,name=FirstFetchTime,proto3" json:"FirstFetchTime,omitempty"`
+	Url            string            `protobuf:"bytes,1,opt,name=Url,proto3" json:"Url,omitempty"`
+	PubDate        uint64            `protobuf:"varint,2,opt,name=PubDate,proto3" json:"PubDate,omitempty"`
+	FetchTime      uint64            `protobuf:"varint,3,opt,name=FetchTime,proto3" json:"FetchTime,omitempty"`
+	Text           string            `protobuf:"bytes,4,opt,name=Text,proto3" json:"Text,omitempty"`
+	FirstFetchTime uint64            `protobuf:"varint,5,opt,name=FirstFetchTime,proto3" json:"FirstFetchTime,omitempty"`
+	Version        uint64            `protobuf:"varint,6,opt,name=Version,proto3" json:"Version,omitempty"`
+	Provenance     map[string]uint64 `protobuf:"bytes,7,rep,name=Provenance,proto3" json:"Provenance,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+	// Url as it was fetched, before normalization.
+	OriginalUrl string `protobuf:"bytes,8,opt,name=OriginalUrl,proto3" json:"OriginalUrl,omitempty"`
 }
 
 func (x *TDocument) Reset() {
@@ -99,11 +103,269 @@ func (x *TDocument) GetFirstFetchTime() uint64 {
 	return 0
 }
 
+func (x *TDocument) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *TDocument) GetProvenance() map[string]uint64 {
+	if x != nil {
+		return x.Provenance
+	}
+	return nil
+}
+
+func (x *TDocument) GetOriginalUrl() string {
+	if x != nil {
+		return x.OriginalUrl
+	}
+	return ""
+}
+
+// TDocumentChange describes how a message changed a stored document.
+type TDocumentChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Url string `protobuf:"bytes,1,opt,name=Url,proto3" json:"Url,omitempty"`
+	// FetchTime of the message that caused the change.
+	FetchTime uint64          `protobuf:"varint,2,opt,name=FetchTime,proto3" json:"FetchTime,omitempty"`
+	Version   uint64          `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
+	New       bool            `protobuf:"varint,4,opt,name=New,proto3" json:"New,omitempty"`
+	Fields    []*TFieldChange `protobuf:"bytes,5,rep,name=Fields,proto3" json:"Fields,omitempty"`
+	// Unified diff of Text, empty when Text did not change.
+	TextDiff string `protobuf:"bytes,6,opt,name=TextDiff,proto3" json:"TextDiff,omitempty"`
+}
+
+func (x *TDocumentChange) Reset() {
+	*x = TDocumentChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tdocument_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TDocumentChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TDocumentChange) ProtoMessage() {}
+
+func (x *TDocumentChange) ProtoReflect() protoreflect.Message {
+	mi := &file_tdocument_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TDocumentChange.ProtoReflect.Descriptor instead.
+func (*TDocumentChange) Descriptor() ([]byte, []int) {
+	return file_tdocument_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TDocumentChange) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *TDocumentChange) GetFetchTime() uint64 {
+	if x != nil {
+		return x.FetchTime
+	}
+	return 0
+}
+
+func (x *TDocumentChange) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *TDocumentChange) GetNew() bool {
+	if x != nil {
+		return x.New
+	}
+	return false
+}
+
+func (x *TDocumentChange) GetFields() []*TFieldChange {
+	if x != nil {
+		return x.Fields
+	}
+	return nil
+}
+
+func (x *TDocumentChange) GetTextDiff() string {
+	if x != nil {
+		return x.TextDiff
+	}
+	return ""
+}
+
+// TFieldChange holds the previous and the new value of a changed field.
+// Numeric values are written in decimal.
+type TFieldChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Field    string `protobuf:"bytes,1,opt,name=Field,proto3" json:"Field,omitempty"`
+	OldValue string `protobuf:"bytes,2,opt,name=OldValue,proto3" json:"OldValue,omitempty"`
+	NewValue string `protobuf:"bytes,3,opt,name=NewValue,proto3" json:"NewValue,omitempty"`
+}
+
+func (x *TFieldChange) Reset() {
+	*x = TFieldChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tdocument_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TFieldChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TFieldChange) ProtoMessage() {}
+
+func (x *TFieldChange) ProtoReflect() protoreflect.Message {
+	mi := &file_tdocument_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TFieldChange.ProtoReflect.Descriptor instead.
+func (*TFieldChange) Descriptor() ([]byte, []int) {
+	return file_tdocument_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *TFieldChange) GetField() string {
+	if x != nil {
+		return x.Field
+	}
+	return ""
+}
+
+func (x *TFieldChange) GetOldValue() string {
+	if x != nil {
+		return x.OldValue
+	}
+	return ""
+}
+
+func (x *TFieldChange) GetNewValue() string {
+	if x != nil {
+		return x.NewValue
+	}
+	return ""
+}
+
+// TRepositoryRecord is a single entry of an InMemoryRepository snapshot or
+// write-ahead log.
+type TRepositoryRecord struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Record:
+	//	*TRepositoryRecord_Document
+	//	*TRepositoryRecord_Version
+	Record isTRepositoryRecord_Record `protobuf_oneof:"Record"`
+}
+
+func (x *TRepositoryRecord) Reset() {
+	*x = TRepositoryRecord{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_tdocument_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *TRepositoryRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TRepositoryRecord) ProtoMessage() {}
+
+func (x *TRepositoryRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_tdocument_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TRepositoryRecord.ProtoReflect.Descriptor instead.
+func (*TRepositoryRecord) Descriptor() ([]byte, []int) {
+	return file_tdocument_proto_rawDescGZIP(), []int{3}
+}
+
+func (m *TRepositoryRecord) GetRecord() isTRepositoryRecord_Record {
+	if m != nil {
+		return m.Record
+	}
+	return nil
+}
+
+func (x *TRepositoryRecord) GetDocument() *TDocument {
+	if x, ok := x.GetRecord().(*TRepositoryRecord_Document); ok {
+		return x.Document
+	}
+	return nil
+}
+
+func (x *TRepositoryRecord) GetVersion() *TDocument {
+	if x, ok := x.GetRecord().(*TRepositoryRecord_Version); ok {
+		return x.Version
+	}
+	return nil
+}
+
+type isTRepositoryRecord_Record interface {
+	isTRepositoryRecord_Record()
+}
+
+type TRepositoryRecord_Document struct {
+	Document *TDocument `protobuf:"bytes,1,opt,name=Document,proto3,oneof"`
+}
+
+type TRepositoryRecord_Version struct {
+	Version *TDocument `protobuf:"bytes,2,opt,name=Version,proto3,oneof"`
+}
+
+func (*TRepositoryRecord_Document) isTRepositoryRecord_Record() {}
+
+func (*TRepositoryRecord_Version) isTRepositoryRecord_Record() {}
+
 var File_tdocument_proto protoreflect.FileDescriptor
 
 var file_tdocument_proto_rawDesc = []byte{
 	0x0a, 0x0f, 0x74, 0x64, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x22, 0x91, 0x01, 0x0a, 0x09, 0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x12,
+	0x6f, 0x22, 0xc8, 0x02, 0x0a, 0x09, 0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x12,
 	0x10, 0x0a, 0x03, 0x55, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x55, 0x72,
 	0x6c, 0x12, 0x18, 0x0a, 0x07, 0x50, 0x75, 0x62, 0x44, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01,
 	0x28, 0x04, 0x52, 0x07, 0x50, 0x75, 0x62, 0x44, 0x61, 0x74, 0x65, 0x12, 0x1c, 0x0a, 0x09, 0x46,
@@ -112,8 +374,44 @@ var file_tdocument_proto_rawDesc = []byte{
 	0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x54, 0x65, 0x78, 0x74, 0x12, 0x26, 0x0a,
 	0x0e, 0x46, 0x69, 0x72, 0x73, 0x74, 0x46, 0x65, 0x74, 0x63, 0x68, 0x54, 0x69, 0x6d, 0x65, 0x18,
 	0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0e, 0x46, 0x69, 0x72, 0x73, 0x74, 0x46, 0x65, 0x74, 0x63,
-	0x68, 0x54, 0x69, 0x6d, 0x65, 0x42, 0x0b, 0x5a, 0x09, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x68, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x06, 0x20, 0x01, 0x28, 0x04, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x3a, 0x0a, 0x0a, 0x50, 0x72, 0x6f, 0x76, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x18, 0x07, 0x20,
+	0x03, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x2e,
+	0x50, 0x72, 0x6f, 0x76, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52,
+	0x0a, 0x50, 0x72, 0x6f, 0x76, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x12, 0x20, 0x0a, 0x0b, 0x4f,
+	0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x55, 0x72, 0x6c, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x4f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x55, 0x72, 0x6c, 0x1a, 0x3d, 0x0a,
+	0x0f, 0x50, 0x72, 0x6f, 0x76, 0x65, 0x6e, 0x61, 0x6e, 0x63, 0x65, 0x45, 0x6e, 0x74, 0x72, 0x79,
+	0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b,
+	0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0xb0, 0x01, 0x0a,
+	0x0f, 0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65,
+	0x12, 0x10, 0x0a, 0x03, 0x55, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x55,
+	0x72, 0x6c, 0x12, 0x1c, 0x0a, 0x09, 0x46, 0x65, 0x74, 0x63, 0x68, 0x54, 0x69, 0x6d, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x46, 0x65, 0x74, 0x63, 0x68, 0x54, 0x69, 0x6d, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x07, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x10, 0x0a, 0x03, 0x4e, 0x65,
+	0x77, 0x18, 0x04, 0x20, 0x01, 0x28, 0x08, 0x52, 0x03, 0x4e, 0x65, 0x77, 0x12, 0x25, 0x0a, 0x06,
+	0x46, 0x69, 0x65, 0x6c, 0x64, 0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x54,
+	0x46, 0x69, 0x65, 0x6c, 0x64, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x52, 0x06, 0x46, 0x69, 0x65,
+	0x6c, 0x64, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x54, 0x65, 0x78, 0x74, 0x44, 0x69, 0x66, 0x66, 0x18,
+	0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x54, 0x65, 0x78, 0x74, 0x44, 0x69, 0x66, 0x66, 0x22,
+	0x5c, 0x0a, 0x0c, 0x54, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x43, 0x68, 0x61, 0x6e, 0x67, 0x65, 0x12,
+	0x14, 0x0a, 0x05, 0x46, 0x69, 0x65, 0x6c, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x46, 0x69, 0x65, 0x6c, 0x64, 0x12, 0x1a, 0x0a, 0x08, 0x4f, 0x6c, 0x64, 0x56, 0x61, 0x6c, 0x75,
+	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x4f, 0x6c, 0x64, 0x56, 0x61, 0x6c, 0x75,
+	0x65, 0x12, 0x1a, 0x0a, 0x08, 0x4e, 0x65, 0x77, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x08, 0x4e, 0x65, 0x77, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x22, 0x6f, 0x0a,
+	0x11, 0x54, 0x52, 0x65, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x63, 0x6f,
+	0x72, 0x64, 0x12, 0x28, 0x0a, 0x08, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74,
+	0x48, 0x00, 0x52, 0x08, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x12, 0x26, 0x0a, 0x07,
+	0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0a, 0x2e,
+	0x54, 0x44, 0x6f, 0x63, 0x75, 0x6d, 0x65, 0x6e, 0x74, 0x48, 0x00, 0x52, 0x07, 0x56, 0x65, 0x72,
+	0x73, 0x69, 0x6f, 0x6e, 0x42, 0x08, 0x0a, 0x06, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x42, 0x0b,
+	0x5a, 0x09, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
 }
 
 var (
@@ -128,16 +426,24 @@ func file_tdocument_proto_rawDescGZIP() []byte {
 	return file_tdocument_proto_rawDescData
 }
 
-var file_tdocument_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_tdocument_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_tdocument_proto_goTypes = []any{
-	(*TDocument)(nil), // 0: TDocument
+	(*TDocument)(nil),         // 0: TDocument
+	(*TDocumentChange)(nil),   // 1: TDocumentChange
+	(*TFieldChange)(nil),      // 2: TFieldChange
+	(*TRepositoryRecord)(nil), // 3: TRepositoryRecord
+	nil,                       // 4: TDocument.ProvenanceEntry
 }
 var file_tdocument_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	4, // 0: TDocument.Provenance:type_name -> TDocument.ProvenanceEntry
+	2, // 1: TDocumentChange.Fields:type_name -> TFieldChange
+	0, // 2: TRepositoryRecord.Document:type_name -> TDocument
+	0, // 3: TRepositoryRecord.Version:type_name -> TDocument
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_tdocument_proto_init() }
@@ -158,6 +464,46 @@ func file_tdocument_proto_init() {
 				return nil
 			}
 		}
+		file_tdocument_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*TDocumentChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tdocument_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*TFieldChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_tdocument_proto_msgTypes[3].Exporter = func(v any, i int) any {
+			switch v := v.(*TRepositoryRecord); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_tdocument_proto_msgTypes[3].OneofWrappers = []any{
+		(*TRepositoryRecord_Document)(nil),
+		(*TRepositoryRecord_Version)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -165,7 +511,7 @@ func file_tdocument_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_tdocument_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
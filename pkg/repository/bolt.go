@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	"vk/pkg/model"
+	"vk/pkg/proto"
+
+	"go.etcd.io/bbolt"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+var (
+	documentsBucket = []byte("documents")
+	versionsBucket  = []byte("versions")
+)
+
+// BoltRepository keeps documents in an embedded bbolt file. Documents are
+// stored as TDocument in the documents bucket keyed by url, versions in a
+// nested bucket per url keyed by big-endian fetch time. Document locks are
+// local to the process, like in InMemoryRepository.
+type BoltRepository struct {
+	db    *bbolt.DB
+	locks *lockTable
+
+	options
+}
+
+func NewBoltRepository(db *bbolt.DB, opts ...Option) (*BoltRepository, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(documentsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(versionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltRepository{db: db, locks: newLockTable(), options: newOptions(opts)}, nil
+}
+
+func (repo *BoltRepository) GetDocument(_ context.Context, url string) (*model.Document, error) {
+	var doc *model.Document
+	err := repo.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		doc, err = getBoltDocument(tx, url)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrDocumentNotFound
+	}
+	return doc, nil
+}
+
+func (repo *BoltRepository) SaveDocument(_ context.Context, doc *model.Document) error {
+	return repo.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := getBoltDocument(tx, doc.Url)
+		if err != nil {
+			return err
+		}
+
+		var version uint64
+		if stored != nil {
+			version = stored.Version
+		}
+		return putBoltDocument(tx, doc, version+1)
+	})
+}
+
+func (repo *BoltRepository) SaveDocumentIfVersion(_ context.Context, doc *model.Document, expected uint64) error {
+	return repo.db.Update(func(tx *bbolt.Tx) error {
+		stored, err := getBoltDocument(tx, doc.Url)
+		if err != nil {
+			return err
+		}
+
+		var current uint64
+		if stored != nil {
+			current = stored.Version
+		}
+		if current != expected {
+			return &VersionConflictError{Url: doc.Url, Expected: expected}
+		}
+		return putBoltDocument(tx, doc, expected+1)
+	})
+}
+
+func (repo *BoltRepository) SaveVersion(_ context.Context, doc *model.Document) error {
+	return repo.db.Update(func(tx *bbolt.Tx) error {
+		versions, err := tx.Bucket(versionsBucket).CreateBucketIfNotExists([]byte(doc.Url))
+		if err != nil {
+			return err
+		}
+
+		key := fetchTimeKey(doc.FetchTime)
+		if versions.Get(key) != nil {
+			return nil
+		}
+
+		version := *doc
+		version.Version = 0
+		version.Provenance = nil
+		value, err := gproto.Marshal(documentToProto(&version))
+		if err != nil {
+			return err
+		}
+		return versions.Put(key, value)
+	})
+}
+
+func (repo *BoltRepository) ListVersions(_ context.Context, url string) ([]*model.Document, error) {
+	versions := []*model.Document{}
+	err := repo.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(versionsBucket).Bucket([]byte(url))
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(_, value []byte) error {
+			version, err := unmarshalBoltDocument(value)
+			if err != nil {
+				return err
+			}
+			versions = append(versions, version)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (repo *BoltRepository) GetVersionAt(_ context.Context, url string, fetchTime uint64) (*model.Document, error) {
+	var version *model.Document
+	err := repo.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(versionsBucket).Bucket([]byte(url))
+		if bucket == nil {
+			return nil
+		}
+
+		target := fetchTimeKey(fetchTime)
+		cursor := bucket.Cursor()
+
+		key, value := cursor.Seek(target)
+		if key == nil {
+			key, value = cursor.Last()
+		} else if !bytes.Equal(key, target) {
+			key, value = cursor.Prev()
+		}
+		if key == nil {
+			return nil
+		}
+
+		var err error
+		version, err = unmarshalBoltDocument(value)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return nil, ErrVersionNotFound
+	}
+	return version, nil
+}
+
+func (repo *BoltRepository) LockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	timeout, stop := repo.lockTimeoutTimer()
+	defer stop()
+
+	return repo.locks.Lock(ctx, url, timeout)
+}
+
+func (repo *BoltRepository) TryLockDocument(_ context.Context, url string) (DocumentLock, error) {
+	return repo.locks.TryLock(url)
+}
+
+func getBoltDocument(tx *bbolt.Tx, url string) (*model.Document, error) {
+	value := tx.Bucket(documentsBucket).Get([]byte(url))
+	if value == nil {
+		return nil, nil
+	}
+	return unmarshalBoltDocument(value)
+}
+
+// putBoltDocument stores doc with the given version and sets doc.Version.
+func putBoltDocument(tx *bbolt.Tx, doc *model.Document, version uint64) error {
+	stored := *doc
+	stored.Version = version
+
+	value, err := gproto.Marshal(documentToProto(&stored))
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(documentsBucket).Put([]byte(doc.Url), value); err != nil {
+		return err
+	}
+
+	doc.Version = version
+	return nil
+}
+
+func unmarshalBoltDocument(value []byte) (*model.Document, error) {
+	doc := &proto.TDocument{}
+	if err := gproto.Unmarshal(value, doc); err != nil {
+		return nil, err
+	}
+	return documentFromProto(doc), nil
+}
+
+func fetchTimeKey(fetchTime uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, fetchTime)
+}
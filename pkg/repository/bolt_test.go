@@ -0,0 +1,24 @@
+package repository_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"vk/pkg/repository"
+	"vk/pkg/repository/repositorytest"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		db, err := bbolt.Open(filepath.Join(t.TempDir(), "documents.db"), 0o600, nil)
+		require.NoError(t, err, "expected no error opening database")
+		t.Cleanup(func() { db.Close() })
+
+		repo, err := repository.NewBoltRepository(db, opts...)
+		require.NoError(t, err, "expected no error creating repository")
+		return repo
+	})
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"vk/pkg/model"
+	"vk/pkg/proto"
+)
+
+func documentToProto(doc *model.Document) *proto.TDocument {
+	return &proto.TDocument{
+		Url:            doc.Url,
+		PubDate:        doc.PubDate,
+		FetchTime:      doc.FetchTime,
+		Text:           doc.Text,
+		FirstFetchTime: doc.FirstFetchTime,
+		Version:        doc.Version,
+		Provenance:     doc.Provenance,
+		OriginalUrl:    doc.OriginalUrl,
+	}
+}
+
+func documentFromProto(doc *proto.TDocument) *model.Document {
+	return &model.Document{
+		Url:            doc.Url,
+		PubDate:        doc.PubDate,
+		FetchTime:      doc.FetchTime,
+		Text:           doc.Text,
+		FirstFetchTime: doc.FirstFetchTime,
+		Version:        doc.Version,
+		Provenance:     model.Provenance(doc.Provenance).Copy(),
+		OriginalUrl:    doc.OriginalUrl,
+	}
+}
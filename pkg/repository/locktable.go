@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockTable hands out per-key locks within the process. An entry is kept only
+// while some goroutine holds or waits for its lock, so the table does not grow
+// with the number of distinct keys ever locked.
+type lockTable struct {
+	mutex   sync.Mutex
+	entries map[string]*lockEntry
+}
+
+type lockEntry struct {
+	lock chan struct{}
+	refs int
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{entries: make(map[string]*lockEntry)}
+}
+
+// Lock waits for the lock of key. It returns ErrLockTimeout when timeout fires
+// first; a nil timeout waits until ctx is done.
+func (t *lockTable) Lock(ctx context.Context, key string, timeout <-chan time.Time) (DocumentLock, error) {
+	entry := t.acquire(key)
+
+	select {
+	case entry.lock <- struct{}{}:
+		return &tableLock{table: t, key: key, entry: entry}, nil
+	case <-timeout:
+		t.release(key, entry)
+		return nil, ErrLockTimeout
+	case <-ctx.Done():
+		t.release(key, entry)
+		return nil, ctx.Err()
+	}
+}
+
+func (t *lockTable) TryLock(key string) (DocumentLock, error) {
+	entry := t.acquire(key)
+
+	select {
+	case entry.lock <- struct{}{}:
+		return &tableLock{table: t, key: key, entry: entry}, nil
+	default:
+		t.release(key, entry)
+		return nil, ErrLockBusy
+	}
+}
+
+func (t *lockTable) acquire(key string) *lockEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry, exists := t.entries[key]
+	if !exists {
+		entry = &lockEntry{lock: make(chan struct{}, 1)}
+		t.entries[key] = entry
+	}
+	entry.refs++
+	return entry
+}
+
+func (t *lockTable) release(key string, entry *lockEntry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 {
+		delete(t.entries, key)
+	}
+}
+
+type tableLock struct {
+	table    *lockTable
+	key      string
+	entry    *lockEntry
+	released atomic.Bool
+}
+
+func (lock *tableLock) Unlock(_ context.Context) error {
+	if !lock.released.CompareAndSwap(false, true) {
+		return ErrLockNotHeld
+	}
+
+	<-lock.entry.lock
+	lock.table.release(lock.key, lock.entry)
+	return nil
+}
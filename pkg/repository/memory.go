@@ -1,26 +1,34 @@
 package repository
 
 import (
+	"context"
+	"sort"
 	"sync"
 
 	"vk/pkg/model"
 )
 
 type InMemoryRepository struct {
-	data           map[string]*model.Document
-	dataMutex      sync.RWMutex
-	conditionMutex sync.Mutex
-	condition      map[string]*sync.Mutex
+	data      map[string]*model.Document
+	versions  map[string][]*model.Document
+	dataMutex sync.RWMutex
+	locks     *lockTable
+
+	persistence *memoryPersistence
+
+	options
 }
 
-func NewInMemoryRepository() *InMemoryRepository {
+func NewInMemoryRepository(opts ...Option) *InMemoryRepository {
 	return &InMemoryRepository{
-		data:      make(map[string]*model.Document),
-		condition: make(map[string]*sync.Mutex),
+		data:     make(map[string]*model.Document),
+		versions: make(map[string][]*model.Document),
+		locks:    newLockTable(),
+		options:  newOptions(opts),
 	}
 }
 
-func (repo *InMemoryRepository) GetDocument(url string) (*model.Document, error) {
+func (repo *InMemoryRepository) GetDocument(_ context.Context, url string) (*model.Document, error) {
 	repo.dataMutex.RLock()
 	defer repo.dataMutex.RUnlock()
 
@@ -28,41 +36,124 @@ func (repo *InMemoryRepository) GetDocument(url string) (*model.Document, error)
 	if !exists {
 		return nil, ErrDocumentNotFound
 	}
-	return doc, nil
+
+	return doc.Copy(), nil
 }
 
-func (repo *InMemoryRepository) SaveDocument(doc *model.Document) error {
+func (repo *InMemoryRepository) SaveDocument(_ context.Context, doc *model.Document) error {
 	repo.dataMutex.Lock()
 	defer repo.dataMutex.Unlock()
 
-	repo.data[doc.Url] = doc
-	return nil
+	return repo.store(doc)
 }
 
-func (repo *InMemoryRepository) LockDocument(url string) error {
-	repo.conditionMutex.Lock()
+func (repo *InMemoryRepository) SaveDocumentIfVersion(_ context.Context, doc *model.Document, expected uint64) error {
+	repo.dataMutex.Lock()
+	defer repo.dataMutex.Unlock()
 
-	mutex, exists := repo.condition[url]
-	if !exists {
-		mutex = &sync.Mutex{}
-		repo.condition[url] = mutex
+	var current uint64
+	if stored, exists := repo.data[doc.Url]; exists {
+		current = stored.Version
+	}
+	if current != expected {
+		return &VersionConflictError{Url: doc.Url, Expected: expected}
 	}
 
-	repo.conditionMutex.Unlock()
+	return repo.store(doc)
+}
+
+// store must be called with dataMutex held.
+func (repo *InMemoryRepository) store(doc *model.Document) error {
+	var version uint64
+	if stored, exists := repo.data[doc.Url]; exists {
+		version = stored.Version
+	}
 
-	mutex.Lock()
+	stored := doc.Copy()
+	stored.Version = version + 1
+	if err := repo.logDocument(stored); err != nil {
+		return err
+	}
+
+	repo.data[doc.Url] = stored
+	doc.Version = stored.Version
 	return nil
 }
 
-func (repo *InMemoryRepository) UnlockDocument(url string) error {
-	repo.conditionMutex.Lock()
-	defer repo.conditionMutex.Unlock()
+func (repo *InMemoryRepository) SaveVersion(_ context.Context, doc *model.Document) error {
+	repo.dataMutex.Lock()
+	defer repo.dataMutex.Unlock()
 
-	mutex, exists := repo.condition[url]
-	if !exists {
-		return ErrDocumentNotFound
+	if _, exists := repo.findVersion(doc.Url, doc.FetchTime); exists {
+		return nil
 	}
 
-	mutex.Unlock()
+	version := *doc
+	version.Version = 0
+	version.Provenance = nil
+	if err := repo.logVersion(&version); err != nil {
+		return err
+	}
+
+	repo.insertVersion(&version)
 	return nil
 }
+
+// findVersion must be called with dataMutex held.
+func (repo *InMemoryRepository) findVersion(url string, fetchTime uint64) (int, bool) {
+	versions := repo.versions[url]
+	idx := sort.Search(len(versions), func(i int) bool {
+		return versions[i].FetchTime >= fetchTime
+	})
+	return idx, idx < len(versions) && versions[idx].FetchTime == fetchTime
+}
+
+// insertVersion must be called with dataMutex held.
+func (repo *InMemoryRepository) insertVersion(version *model.Document) {
+	idx, exists := repo.findVersion(version.Url, version.FetchTime)
+	if exists {
+		return
+	}
+
+	versions := append(repo.versions[version.Url], nil)
+	copy(versions[idx+1:], versions[idx:])
+	versions[idx] = version
+	repo.versions[version.Url] = versions
+}
+
+func (repo *InMemoryRepository) ListVersions(_ context.Context, url string) ([]*model.Document, error) {
+	repo.dataMutex.RLock()
+	defer repo.dataMutex.RUnlock()
+
+	versions := make([]*model.Document, 0, len(repo.versions[url]))
+	for _, version := range repo.versions[url] {
+		versions = append(versions, version.Copy())
+	}
+	return versions, nil
+}
+
+func (repo *InMemoryRepository) GetVersionAt(_ context.Context, url string, fetchTime uint64) (*model.Document, error) {
+	repo.dataMutex.RLock()
+	defer repo.dataMutex.RUnlock()
+
+	versions := repo.versions[url]
+	idx := sort.Search(len(versions), func(i int) bool {
+		return versions[i].FetchTime > fetchTime
+	})
+	if idx == 0 {
+		return nil, ErrVersionNotFound
+	}
+
+	return versions[idx-1].Copy(), nil
+}
+
+func (repo *InMemoryRepository) LockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	timeout, stop := repo.lockTimeoutTimer()
+	defer stop()
+
+	return repo.locks.Lock(ctx, url, timeout)
+}
+
+func (repo *InMemoryRepository) TryLockDocument(_ context.Context, url string) (DocumentLock, error) {
+	return repo.locks.TryLock(url)
+}
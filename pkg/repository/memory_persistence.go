@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"vk/pkg/model"
+	"vk/pkg/proto"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+const (
+	snapshotFileName = "snapshot.pb"
+	walFileName      = "wal.pb"
+)
+
+// memoryPersistence keeps an InMemoryRepository on disk as a snapshot of all
+// documents and versions plus a write-ahead log of changes made since the
+// snapshot. Both files are sequences of size-delimited TRepositoryRecord.
+type memoryPersistence struct {
+	dir  string
+	wal  *os.File
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenInMemoryRepository restores an InMemoryRepository from the snapshot and
+// the write-ahead log in dir and keeps logging every change there. A new
+// snapshot is taken every snapshotInterval (never if it is zero) and on Close.
+func OpenInMemoryRepository(dir string, snapshotInterval time.Duration, opts ...Option) (*InMemoryRepository, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	repo := NewInMemoryRepository(opts...)
+
+	if err := repo.replay(filepath.Join(dir, snapshotFileName), false); err != nil {
+		return nil, fmt.Errorf("can't restore snapshot: %w", err)
+	}
+
+	walPath := filepath.Join(dir, walFileName)
+	if err := repo.replay(walPath, true); err != nil {
+		return nil, fmt.Errorf("can't replay write-ahead log: %w", err)
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.persistence = &memoryPersistence{
+		dir:  dir,
+		wal:  wal,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if snapshotInterval > 0 {
+		go repo.snapshotLoop(snapshotInterval)
+	} else {
+		close(repo.persistence.done)
+	}
+
+	return repo, nil
+}
+
+// Snapshot writes all documents and versions to the snapshot file and empties
+// the write-ahead log. Writes are blocked while the snapshot is taken.
+func (repo *InMemoryRepository) Snapshot() error {
+	if repo.persistence == nil {
+		return nil
+	}
+
+	repo.dataMutex.Lock()
+	defer repo.dataMutex.Unlock()
+
+	return repo.persistence.snapshot(repo.data, repo.versions)
+}
+
+// Close takes a final snapshot and closes the write-ahead log. Later calls
+// return the result of the first one.
+func (repo *InMemoryRepository) Close() error {
+	if repo.persistence == nil {
+		return nil
+	}
+
+	repo.persistence.closeOnce.Do(func() {
+		close(repo.persistence.stop)
+		<-repo.persistence.done
+
+		if err := repo.Snapshot(); err != nil {
+			repo.persistence.closeErr = err
+			return
+		}
+		repo.persistence.closeErr = repo.persistence.wal.Close()
+	})
+	return repo.persistence.closeErr
+}
+
+func (repo *InMemoryRepository) snapshotLoop(interval time.Duration) {
+	defer close(repo.persistence.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := repo.Snapshot(); err != nil {
+				log.Printf("Failed to snapshot repository: %v\n", err)
+			}
+		case <-repo.persistence.stop:
+			return
+		}
+	}
+}
+
+// replay applies records from the file at path. If tolerateTail is set, a
+// record cut short at the end of the file by a crash is dropped.
+func (repo *InMemoryRepository) replay(path string, tolerateTail bool) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := &countingReader{Reader: bufio.NewReader(file)}
+	for {
+		offset := reader.count
+		record := &proto.TRepositoryRecord{}
+
+		err := protodelim.UnmarshalFrom(reader, record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, peekErr := reader.Peek(1); tolerateTail && peekErr == io.EOF {
+				log.Printf("Dropping incomplete record at the end of %s: %v\n", path, err)
+				return os.Truncate(path, offset)
+			}
+			return err
+		}
+
+		switch r := record.Record.(type) {
+		case *proto.TRepositoryRecord_Document:
+			doc := documentFromProto(r.Document)
+			repo.data[doc.Url] = doc
+		case *proto.TRepositoryRecord_Version:
+			repo.insertVersion(documentFromProto(r.Version))
+		}
+	}
+}
+
+// logDocument must be called with dataMutex held.
+func (repo *InMemoryRepository) logDocument(doc *model.Document) error {
+	if repo.persistence == nil {
+		return nil
+	}
+	return repo.persistence.append(&proto.TRepositoryRecord{
+		Record: &proto.TRepositoryRecord_Document{Document: documentToProto(doc)},
+	})
+}
+
+// logVersion must be called with dataMutex held.
+func (repo *InMemoryRepository) logVersion(doc *model.Document) error {
+	if repo.persistence == nil {
+		return nil
+	}
+	return repo.persistence.append(&proto.TRepositoryRecord{
+		Record: &proto.TRepositoryRecord_Version{Version: documentToProto(doc)},
+	})
+}
+
+func (p *memoryPersistence) append(record *proto.TRepositoryRecord) error {
+	if _, err := protodelim.MarshalTo(p.wal, record); err != nil {
+		return err
+	}
+	return p.wal.Sync()
+}
+
+func (p *memoryPersistence) snapshot(data map[string]*model.Document, versions map[string][]*model.Document) error {
+	snapshotPath := filepath.Join(p.dir, snapshotFileName)
+	tmpPath := snapshotPath + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, doc := range data {
+		record := &proto.TRepositoryRecord{
+			Record: &proto.TRepositoryRecord_Document{Document: documentToProto(doc)},
+		}
+		if _, err := protodelim.MarshalTo(writer, record); err != nil {
+			return err
+		}
+	}
+	for _, docVersions := range versions {
+		for _, version := range docVersions {
+			record := &proto.TRepositoryRecord{
+				Record: &proto.TRepositoryRecord_Version{Version: documentToProto(version)},
+			}
+			if _, err := protodelim.MarshalTo(writer, record); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return err
+	}
+	if err := syncDir(p.dir); err != nil {
+		return err
+	}
+
+	// Everything logged so far is in the snapshot now.
+	return p.wal.Truncate(0)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// countingReader tracks the offset of the next unread byte.
+type countingReader struct {
+	*bufio.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.Reader.ReadByte()
+	if err == nil {
+		r.count++
+	}
+	return b, err
+}
@@ -1,18 +1,30 @@
 package repository_test
 
 import (
-	"sync"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
 
 	"vk/pkg/model"
 	"vk/pkg/repository"
+	"vk/pkg/repository/repositorytest"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestInMemoryRepository(t *testing.T) {
-	repo := repository.NewInMemoryRepository()
+	repositorytest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		return repository.NewInMemoryRepository(opts...)
+	})
+}
+
+func TestInMemoryRepository_Persistence(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
 
 	doc := &model.Document{
 		Url:            "http://example.com",
@@ -21,59 +33,127 @@ func TestInMemoryRepository(t *testing.T) {
 		Text:           "12346789",
 		FirstFetchTime: 12346789,
 	}
+	version := &model.Document{
+		Url:            doc.Url,
+		PubDate:        doc.PubDate,
+		FetchTime:      doc.FetchTime,
+		Text:           doc.Text,
+		FirstFetchTime: doc.FirstFetchTime,
+	}
+	otherDoc := &model.Document{
+		Url:            "http://example.com/other",
+		PubDate:        1,
+		FetchTime:      2,
+		Text:           "other content",
+		FirstFetchTime: 2,
+	}
 
-	t.Run("SaveDocument", func(t *testing.T) {
-		err := repo.SaveDocument(doc)
-		assert.NoError(t, err, "expected no error saving document")
+	// open closes the repository when the test is done, so that the
+	// write-ahead log is not left open; reopening without Close is a crash
+	open := func(t *testing.T, snapshotInterval time.Duration) (*repository.InMemoryRepository, error) {
+		repo, err := repository.OpenInMemoryRepository(dir, snapshotInterval)
+		if err == nil {
+			t.Cleanup(func() { repo.Close() })
+		}
+		return repo, err
+	}
 
-		savedDoc, err := repo.GetDocument(doc.Url)
-		assert.NoError(t, err, "expected no error getting document")
+	t.Run("RestoreFromWriteAheadLog", func(t *testing.T) {
+		repo, err := open(t, 0)
+		assert.NoError(t, err, "expected no error opening repository")
+
+		assert.NoError(t, repo.SaveVersion(ctx, version), "expected no error saving version")
+		assert.NoError(t, repo.SaveDocument(ctx, doc), "expected no error saving document")
+
+		// Reopen without Close, as after a crash.
+		restored, err := open(t, 0)
+		assert.NoError(t, err, "expected no error restoring repository")
+
+		savedDoc, err := restored.GetDocument(ctx, doc.Url)
+		assert.NoError(t, err, "expected no error getting restored document")
 		assert.Equal(t, doc, savedDoc, "expected to get the saved document")
-	})
 
-	t.Run("GetDocument_NotFound", func(t *testing.T) {
-		_, err := repo.GetDocument("http://notfound.com")
-		assert.Error(t, err, "expected error for not found document")
-		assert.Equal(t, "document not found", err.Error(), "expected 'document not found' error")
+		versions, err := restored.ListVersions(ctx, doc.Url)
+		assert.NoError(t, err, "expected no error listing restored versions")
+		assert.Equal(t, []*model.Document{version}, versions, "expected to get the saved versions")
 	})
 
-	t.Run("LockDocument", func(t *testing.T) {
-		gorutinesCount := 3
-		sleepTime := time.Second * 1
-		expectedWorkDuration := sleepTime * time.Duration(gorutinesCount)
-
-		wg := sync.WaitGroup{}
-		wg.Add(gorutinesCount)
-
-		startTime := time.Now()
-
-		idx := 0
-		for idx < gorutinesCount {
-			go func() {
-				defer wg.Done()
-				err := repo.LockDocument(doc.Url)
-				assert.NoError(t, err, "expected no error locking document again")
-				<-time.After(sleepTime)
-				repo.UnlockDocument(doc.Url)
-			}()
-			idx += 1
+	t.Run("RestoreFromSnapshotAndWriteAheadLog", func(t *testing.T) {
+		repo, err := open(t, 0)
+		assert.NoError(t, err, "expected no error opening repository")
+
+		assert.NoError(t, repo.Snapshot(), "expected no error taking snapshot")
+		assert.NoError(t, repo.SaveDocument(ctx, otherDoc), "expected no error saving document")
+
+		restored, err := open(t, 0)
+		assert.NoError(t, err, "expected no error restoring repository")
+
+		for _, expected := range []*model.Document{doc, otherDoc} {
+			savedDoc, err := restored.GetDocument(ctx, expected.Url)
+			assert.NoError(t, err, "expected no error getting restored document")
+			assert.Equal(t, expected, savedDoc, "expected to get the saved document")
 		}
+	})
 
-		wg.Wait()
+	t.Run("DropIncompleteRecord", func(t *testing.T) {
+		wal, err := os.OpenFile(filepath.Join(dir, "wal.pb"), os.O_WRONLY|os.O_APPEND, 0o644)
+		assert.NoError(t, err, "expected no error opening write-ahead log")
+		_, err = wal.Write([]byte{0x20, 0x0a, 0x1e})
+		assert.NoError(t, err, "expected no error writing incomplete record")
+		wal.Close()
 
-		endTime := time.Now()
-		workDuration := endTime.Sub(startTime)
+		restored, err := open(t, 0)
+		assert.NoError(t, err, "expected no error restoring repository with incomplete record")
 
-		assert.GreaterOrEqual(
-			t, workDuration, expectedWorkDuration,
-			"expected total work duration to be at least %v, got %v",
-			expectedWorkDuration, workDuration,
-		)
+		savedDoc, err := restored.GetDocument(ctx, otherDoc.Url)
+		assert.NoError(t, err, "expected no error getting restored document")
+		assert.Equal(t, otherDoc, savedDoc, "expected complete records to be restored")
 	})
 
-	t.Run("UnlockDocument_NotFound", func(t *testing.T) {
-		err := repo.UnlockDocument("http://notfound.com")
-		assert.Error(t, err, "expected error unlocking not found document")
-		assert.Equal(t, "document not found", err.Error(), "expected 'document not found' error")
+	t.Run("Close", func(t *testing.T) {
+		repo, err := open(t, time.Millisecond)
+		assert.NoError(t, err, "expected no error opening repository")
+		assert.NoError(t, repo.Close(), "expected no error closing repository")
+		assert.NoError(t, repo.Close(), "expected a second Close to do nothing")
+
+		info, err := os.Stat(filepath.Join(dir, "wal.pb"))
+		assert.NoError(t, err, "expected write-ahead log to exist")
+		assert.Zero(t, info.Size(), "expected write-ahead log to be empty after the final snapshot")
+
+		restored, err := open(t, 0)
+		assert.NoError(t, err, "expected no error restoring repository")
+
+		savedDoc, err := restored.GetDocument(ctx, doc.Url)
+		assert.NoError(t, err, "expected no error getting restored document")
+		assert.Equal(t, doc, savedDoc, "expected to get the saved document")
 	})
 }
+
+// BenchmarkInMemoryRepository_LockDistinctURLs reports the heap retained after
+// locking b.N distinct URLs, which should stay flat as b.N grows:
+//
+//	go test -run '^$' -bench LockDistinctURLs -benchtime 1000000x ./pkg/repository
+func BenchmarkInMemoryRepository_LockDistinctURLs(b *testing.B) {
+	ctx := context.Background()
+	repo := repository.NewInMemoryRepository()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lock, err := repo.LockDocument(ctx, "http://example.com/"+strconv.Itoa(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		lock.Unlock(ctx)
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(repo)
+
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "retained-heap-bytes")
+}
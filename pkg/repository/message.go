@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrMessageProcessed is returned by SaveDocument and SaveDocumentIfVersion
+// when the message from the context has already been saved.
+var ErrMessageProcessed = errors.New("message is already processed")
+
+// MessageID identifies the Kafka message a document comes from.
+type MessageID struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+type messageIDKey struct{}
+
+// WithMessageID attaches the message to the context. Repositories that support
+// it save a document from a message at most once; PostgresRepository does.
+func WithMessageID(ctx context.Context, id MessageID) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+func MessageIDFromContext(ctx context.Context) (MessageID, bool) {
+	id, ok := ctx.Value(messageIDKey{}).(MessageID)
+	return id, ok
+}
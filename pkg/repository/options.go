@@ -0,0 +1,55 @@
+package repository
+
+import "time"
+
+// minLockPollInterval keeps a lock poll from spinning on the CPU.
+const minLockPollInterval = time.Millisecond
+
+type options struct {
+	lockTimeout         time.Duration
+	lockPollInterval    time.Duration
+	maxLockPollInterval time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		lockPollInterval:    10 * time.Millisecond,
+		maxLockPollInterval: 500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Option configures a repository.
+type Option func(*options)
+
+// WithLockTimeout bounds how long LockDocument waits for a lock. When the
+// timeout expires LockDocument returns ErrLockTimeout. Zero means no timeout.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.lockTimeout = timeout
+	}
+}
+
+// WithLockPollInterval sets the backoff bounds used by repositories that have
+// to poll for a lock, such as PostgresRepository. Intervals are at least 1ms
+// and maxInterval is at least interval.
+func WithLockPollInterval(interval, maxInterval time.Duration) Option {
+	return func(o *options) {
+		o.lockPollInterval = max(interval, minLockPollInterval)
+		o.maxLockPollInterval = max(maxInterval, o.lockPollInterval)
+	}
+}
+
+// lockTimeoutTimer returns a channel that fires when the lock wait times out,
+// or nil if there is no timeout.
+func (o options) lockTimeoutTimer() (<-chan time.Time, func()) {
+	if o.lockTimeout <= 0 {
+		return nil, func() {}
+	}
+
+	timer := time.NewTimer(o.lockTimeout)
+	return timer.C, func() { timer.Stop() }
+}
@@ -0,0 +1,18 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithLockPollInterval(t *testing.T) {
+	o := newOptions([]Option{WithLockPollInterval(0, -time.Second)})
+	assert.Equal(t, minLockPollInterval, o.lockPollInterval, "expected a non-positive interval to be clamped")
+	assert.Equal(t, minLockPollInterval, o.maxLockPollInterval, "expected the max interval to be at least the interval")
+
+	o = newOptions([]Option{WithLockPollInterval(20*time.Millisecond, time.Second)})
+	assert.Equal(t, 20*time.Millisecond, o.lockPollInterval)
+	assert.Equal(t, time.Second, o.maxLockPollInterval)
+}
@@ -1,7 +1,12 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"math/rand/v2"
+	"sync"
+	"time"
 
 	"vk/pkg/model"
 
@@ -10,15 +15,17 @@ import (
 
 type PostgresRepository struct {
 	db *sqlx.DB
+
+	options
 }
 
-func NewPostgresRepository(db *sqlx.DB) *PostgresRepository {
-	return &PostgresRepository{db: db}
+func NewPostgresRepository(db *sqlx.DB, opts ...Option) *PostgresRepository {
+	return &PostgresRepository{db: db, options: newOptions(opts)}
 }
 
-func (repo *PostgresRepository) GetDocument(url string) (*model.Document, error) {
+func (repo *PostgresRepository) GetDocument(ctx context.Context, url string) (*model.Document, error) {
 	doc := &model.Document{}
-	err := repo.db.Get(doc, "SELECT url, pub_date, fetch_time, text, first_fetch_time FROM documents WHERE url=$1", url)
+	err := repo.db.GetContext(ctx, doc, "SELECT url, pub_date, fetch_time, text, first_fetch_time, version, provenance, original_url FROM documents WHERE url=$1", url)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -30,25 +37,224 @@ func (repo *PostgresRepository) GetDocument(url string) (*model.Document, error)
 	return doc, nil
 }
 
-func (repo *PostgresRepository) SaveDocument(doc *model.Document) error {
-	_, err := repo.db.NamedExec(`INSERT INTO documents (url, pub_date, fetch_time, text, first_fetch_time) 
-                                VALUES (:url, :pub_date, :fetch_time, :text, :first_fetch_time) 
-                                ON CONFLICT (url) 
-                                DO UPDATE SET pub_date = EXCLUDED.pub_date, 
-                                              fetch_time = EXCLUDED.fetch_time,
-                                              text = EXCLUDED.text, 
-                                              first_fetch_time = EXCLUDED.first_fetch_time`, doc)
+func (repo *PostgresRepository) SaveDocument(ctx context.Context, doc *model.Document) error {
+	return repo.saveOnce(ctx, doc.Url, func(db queryRower) error {
+		return repo.saveDocument(ctx, db, doc)
+	})
+}
+
+func (repo *PostgresRepository) saveDocument(ctx context.Context, db queryRower, doc *model.Document) error {
+	err := db.QueryRowContext(ctx, `INSERT INTO documents (url, pub_date, fetch_time, text, first_fetch_time, provenance, original_url, version) 
+                            VALUES ($1, $2, $3, $4, $5, $6, $7, 1) 
+                            ON CONFLICT (url) 
+                            DO UPDATE SET pub_date = EXCLUDED.pub_date, 
+                                          fetch_time = EXCLUDED.fetch_time,
+                                          text = EXCLUDED.text, 
+                                          first_fetch_time = EXCLUDED.first_fetch_time,
+                                          provenance = EXCLUDED.provenance,
+                                          original_url = EXCLUDED.original_url,
+                                          version = documents.version + 1
+                            RETURNING version`,
+		doc.Url, doc.PubDate, doc.FetchTime, doc.Text, doc.FirstFetchTime, doc.Provenance, doc.OriginalUrl).Scan(&doc.Version)
 	return err
 }
 
-func (repo *PostgresRepository) LockDocument(url string) error {
-	// Using PostgreSQL's advisory locks
-	_, err := repo.db.Exec("SELECT pg_advisory_lock(hashtext($1))", url)
+func (repo *PostgresRepository) SaveDocumentIfVersion(ctx context.Context, doc *model.Document, expected uint64) error {
+	return repo.saveOnce(ctx, doc.Url, func(db queryRower) error {
+		return repo.saveDocumentIfVersion(ctx, db, doc, expected)
+	})
+}
+
+func (repo *PostgresRepository) saveDocumentIfVersion(ctx context.Context, db queryRower, doc *model.Document, expected uint64) error {
+	var row *sql.Row
+	if expected == 0 {
+		row = db.QueryRowContext(ctx, `INSERT INTO documents (url, pub_date, fetch_time, text, first_fetch_time, provenance, original_url, version) 
+                               VALUES ($1, $2, $3, $4, $5, $6, $7, 1) 
+                               ON CONFLICT (url) DO NOTHING
+                               RETURNING version`,
+			doc.Url, doc.PubDate, doc.FetchTime, doc.Text, doc.FirstFetchTime, doc.Provenance, doc.OriginalUrl)
+	} else {
+		row = db.QueryRowContext(ctx, `UPDATE documents SET pub_date = $2, 
+                                                fetch_time = $3,
+                                                text = $4, 
+                                                first_fetch_time = $5,
+                                                provenance = $6,
+                                                original_url = $7,
+                                                version = version + 1
+                               WHERE url = $1 AND version = $8
+                               RETURNING version`,
+			doc.Url, doc.PubDate, doc.FetchTime, doc.Text, doc.FirstFetchTime, doc.Provenance, doc.OriginalUrl, expected)
+	}
+
+	err := row.Scan(&doc.Version)
+	if err == sql.ErrNoRows {
+		return &VersionConflictError{Url: doc.Url, Expected: expected}
+	}
 	return err
 }
 
-func (repo *PostgresRepository) UnlockDocument(url string) error {
-	// Using PostgreSQL's advisory locks
-	_, err := repo.db.Exec("SELECT pg_advisory_unlock(hashtext($1))", url)
+// queryRower is either the database or a transaction.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// saveOnce runs save in a transaction that also records the message from the
+// context in processed_messages, so that a redelivered message is not saved
+// twice. Without a message in the context save runs as is.
+func (repo *PostgresRepository) saveOnce(ctx context.Context, url string, save func(db queryRower) error) error {
+	id, ok := MessageIDFromContext(ctx)
+	if !ok {
+		return save(repo.db)
+	}
+
+	tx, err := repo.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO processed_messages (kafka_topic, kafka_partition, kafka_offset, url)
+                                        VALUES ($1, $2, $3, $4)
+                                        ON CONFLICT DO NOTHING`,
+		id.Topic, id.Partition, id.Offset, url)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return ErrMessageProcessed
+	}
+
+	if err := save(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (repo *PostgresRepository) SaveVersion(ctx context.Context, doc *model.Document) error {
+	_, err := repo.db.NamedExecContext(ctx, `INSERT INTO document_versions (url, pub_date, fetch_time, text, first_fetch_time, original_url)
+                                VALUES (:url, :pub_date, :fetch_time, :text, :first_fetch_time, :original_url)
+                                ON CONFLICT (url, fetch_time) DO NOTHING`, doc)
 	return err
 }
+
+func (repo *PostgresRepository) ListVersions(ctx context.Context, url string) ([]*model.Document, error) {
+	versions := []*model.Document{}
+	err := repo.db.SelectContext(ctx, &versions, `SELECT url, pub_date, fetch_time, text, first_fetch_time, original_url FROM document_versions
+                                     WHERE url=$1 ORDER BY fetch_time`, url)
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (repo *PostgresRepository) GetVersionAt(ctx context.Context, url string, fetchTime uint64) (*model.Document, error) {
+	doc := &model.Document{}
+	err := repo.db.GetContext(ctx, doc, `SELECT url, pub_date, fetch_time, text, first_fetch_time, original_url FROM document_versions
+                            WHERE url=$1 AND fetch_time<=$2 ORDER BY fetch_time DESC LIMIT 1`, url, fetchTime)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// LockDocument polls pg_try_advisory_lock with a jittered exponential backoff
+// until the lock is taken. The lock is held on a connection dedicated to the
+// returned lock, so that it is released on the same session it was taken.
+func (repo *PostgresRepository) LockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	timeout, stop := repo.lockTimeoutTimer()
+	defer stop()
+
+	interval := repo.lockPollInterval
+	for {
+		lock, err := repo.TryLockDocument(ctx, url)
+		if err != ErrLockBusy {
+			return lock, err
+		}
+
+		wait := time.NewTimer(interval/2 + rand.N(interval/2+1))
+		select {
+		case <-wait.C:
+		case <-timeout:
+			wait.Stop()
+			return nil, ErrLockTimeout
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, ctx.Err()
+		}
+
+		interval = min(interval*2, repo.maxLockPollInterval)
+	}
+}
+
+func (repo *PostgresRepository) TryLockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	conn, err := repo.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", url).Scan(&locked)
+	if err != nil {
+		discardConn(conn)
+		return nil, err
+	}
+
+	if !locked {
+		conn.Close()
+		return nil, ErrLockBusy
+	}
+
+	return &postgresLock{conn: conn, url: url}, nil
+}
+
+type postgresLock struct {
+	mutex sync.Mutex
+	conn  *sql.Conn
+	url   string
+}
+
+func (lock *postgresLock) Unlock(ctx context.Context) error {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	conn := lock.conn
+	if conn == nil {
+		return ErrLockNotHeld
+	}
+	lock.conn = nil
+
+	var unlocked bool
+	err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", lock.url).Scan(&unlocked)
+	if err != nil {
+		// The session may still hold the lock, closing it releases the lock.
+		discardConn(conn)
+		return err
+	}
+
+	if err := conn.Close(); err != nil {
+		return err
+	}
+	if !unlocked {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// discardConn closes the underlying session instead of returning it to the pool.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
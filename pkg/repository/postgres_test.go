@@ -1,15 +1,18 @@
 package repository_test
 
 import (
+	"context"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"vk/internal/config"
 	"vk/pkg/model"
 	"vk/pkg/repository"
+	"vk/pkg/repository/repositorytest"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/joho/godotenv"
@@ -17,6 +20,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+var db *sqlx.DB
 var repo *repository.PostgresRepository
 
 func TestMain(m *testing.M) {
@@ -34,82 +38,96 @@ func TestMain(m *testing.M) {
 		" dbname=" + cfg.PostgresDB + " sslmode=disable" +
 		" host=" + cfg.PostgresHost + " port=" + cfg.PostgresPort
 
-	db, err := sqlx.Connect("postgres", dsn)
+	db, err = sqlx.Connect("postgres", dsn)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	db.MustExec("TRUNCATE TABLE documents")
+	db.MustExec("TRUNCATE TABLE documents, document_versions, processed_messages")
 
 	repo = repository.NewPostgresRepository(db)
 
 	code := m.Run()
 
-	db.MustExec("TRUNCATE TABLE documents")
+	db.MustExec("TRUNCATE TABLE documents, document_versions, processed_messages")
 	os.Exit(code)
 }
 
 func TestPostgresRepository(t *testing.T) {
-	doc := &model.Document{
-		Url:            "http://example.com",
-		PubDate:        uint64(time.Now().Unix()),
-		FetchTime:      uint64(time.Now().Unix()),
-		Text:           "example content",
-		FirstFetchTime: uint64(time.Now().Unix()),
+	repositorytest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		db.MustExec("TRUNCATE TABLE documents, document_versions, processed_messages")
+		return repository.NewPostgresRepository(db, opts...)
+	})
+}
+
+func TestPostgresRepository_LockContention(t *testing.T) {
+	ctx := context.Background()
+	url := "http://example.com/contention"
+
+	gorutinesCount := 10
+	iterations := 20
+
+	var holders, overlaps int32
+
+	wg := sync.WaitGroup{}
+	wg.Add(gorutinesCount)
+
+	for idx := 0; idx < gorutinesCount; idx++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				lock, err := repo.LockDocument(ctx, url)
+				if !assert.NoError(t, err, "expected no error locking document") {
+					return
+				}
+
+				if atomic.AddInt32(&holders, 1) > 1 {
+					atomic.AddInt32(&overlaps, 1)
+				}
+				<-time.After(time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+
+				err = lock.Unlock(ctx)
+				assert.NoError(t, err, "expected no error unlocking document")
+			}
+		}()
 	}
 
-	t.Run("SaveDocument", func(t *testing.T) {
-		err := repo.SaveDocument(doc)
-		assert.NoError(t, err, "expected no error saving document")
+	wg.Wait()
 
-		savedDoc, err := repo.GetDocument(doc.Url)
-		assert.NoError(t, err, "expected no error getting document")
-		assert.Equal(t, doc, savedDoc)
-	})
+	assert.Zero(t, overlaps, "expected the lock to be held by one goroutine at a time")
 
-	t.Run("GetDocument_NotFound", func(t *testing.T) {
-		_, err := repo.GetDocument("http://notfound.com")
-		assert.Error(t, err, "expected error for not found document")
-		assert.Equal(t, repository.ErrDocumentNotFound, err, "expected 'document not found' error")
-	})
+	var leaked int
+	err := db.GetContext(ctx, &leaked, `SELECT count(*) FROM pg_locks
+                                       WHERE locktype = 'advisory'
+                                         AND database = (SELECT oid FROM pg_database WHERE datname = current_database())`)
+	assert.NoError(t, err, "expected no error counting advisory locks")
+	assert.Zero(t, leaked, "expected no advisory locks left after unlocking")
+	assert.Zero(t, db.Stats().InUse, "expected every lock connection to be returned to the pool")
+}
 
-	t.Run("LockDocument", func(t *testing.T) {
-		gorutinesCount := 3
-		sleepTime := time.Second * 1
-		expectedWorkDuration := sleepTime * time.Duration(gorutinesCount)
-
-		wg := sync.WaitGroup{}
-		wg.Add(gorutinesCount)
-
-		startTime := time.Now()
-
-		idx := 0
-		for idx < gorutinesCount {
-			go func() {
-				defer wg.Done()
-				err := repo.LockDocument(doc.Url)
-				assert.NoError(t, err, "expected no error locking document again")
-				<-time.After(sleepTime)
-				repo.UnlockDocument(doc.Url)
-			}()
-			idx += 1
-		}
-
-		wg.Wait()
-
-		endTime := time.Now()
-		workDuration := endTime.Sub(startTime)
-
-		assert.GreaterOrEqual(
-			t, workDuration, expectedWorkDuration,
-			"expected total work duration to be at least %v, got %v",
-			expectedWorkDuration, workDuration,
-		)
-	})
+func TestPostgresRepository_MessageID(t *testing.T) {
+	db.MustExec("TRUNCATE TABLE documents, document_versions, processed_messages")
 
-	t.Run("UnlockDocument_NotFound", func(t *testing.T) {
-		err := repo.UnlockDocument("http://notfound.com")
-		// Since we use PostgreSQL advisory locks, unlocking a non-existing document does not raise an error.
-		assert.NoError(t, err, "expected no error unlocking not found document")
-	})
+	doc := &model.Document{Url: "http://example.com/message", FetchTime: 100, Text: "content", FirstFetchTime: 100}
+	ctx := repository.WithMessageID(context.Background(), repository.MessageID{Topic: "documents-in", Partition: 1, Offset: 42})
+
+	err := repo.SaveDocumentIfVersion(ctx, doc, 0)
+	assert.NoError(t, err, "expected no error saving document from a message")
+
+	doc.Text = "redelivered content"
+	err = repo.SaveDocument(ctx, doc)
+	assert.ErrorIs(t, err, repository.ErrMessageProcessed, "expected the redelivered message not to be saved")
+
+	savedDoc, err := repo.GetDocument(context.Background(), doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, "content", savedDoc.Text, "expected the document of the first delivery")
+	assert.Equal(t, uint64(1), savedDoc.Version, "expected the redelivery not to bump the version")
+
+	next := repository.WithMessageID(context.Background(), repository.MessageID{Topic: "documents-in", Partition: 1, Offset: 43})
+	err = repo.SaveDocumentIfVersion(next, doc, 0)
+	assert.ErrorIs(t, err, repository.ErrVersionConflict, "expected a version conflict")
+
+	err = repo.SaveDocumentIfVersion(next, doc, 1)
+	assert.NoError(t, err, "expected the message to be saved after the conflict is rolled back")
 }
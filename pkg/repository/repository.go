@@ -1,16 +1,65 @@
 package repository
 
 import (
+	"context"
+	"fmt"
+
 	"vk/pkg/model"
 
 	"errors"
 )
 
 var ErrDocumentNotFound = errors.New("document not found")
+var ErrVersionNotFound = errors.New("version not found")
+var ErrVersionConflict = errors.New("document version conflict")
+var ErrLockNotHeld = errors.New("lock is not held")
+var ErrLockBusy = errors.New("document is locked")
+var ErrLockTimeout = errors.New("document lock timeout")
+
+// VersionConflictError is returned by SaveDocumentIfVersion when the stored
+// document version differs from the expected one.
+type VersionConflictError struct {
+	Url      string
+	Expected uint64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: %s: expected version %d", ErrVersionConflict, e.Url, e.Expected)
+}
+
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// DocumentLock is a lock on a single document returned by LockDocument.
+type DocumentLock interface {
+	// Unlock releases the lock. Releasing it again returns ErrLockNotHeld.
+	Unlock(ctx context.Context) error
+}
 
 type Repository interface {
-	GetDocument(url string) (*model.Document, error)
-	SaveDocument(doc *model.Document) error
-	LockDocument(url string) error
-	UnlockDocument(url string) error
+	GetDocument(ctx context.Context, url string) (*model.Document, error)
+	// SaveDocument stores the document unconditionally and sets doc.Version
+	// to the new stored version. Both save methods fail with
+	// ErrMessageProcessed if the message from WithMessageID is saved already.
+	SaveDocument(ctx context.Context, doc *model.Document) error
+	// SaveDocumentIfVersion stores the document only if the stored version
+	// equals expected (0 means the document must not exist yet) and sets
+	// doc.Version to the new stored version. Otherwise it fails with
+	// *VersionConflictError.
+	SaveDocumentIfVersion(ctx context.Context, doc *model.Document, expected uint64) error
+	// LockDocument waits for the document lock. It returns ErrLockTimeout if
+	// the repository lock timeout expires first.
+	LockDocument(ctx context.Context, url string) (DocumentLock, error)
+	// TryLockDocument takes the document lock without waiting or returns
+	// ErrLockBusy if it is held by someone else.
+	TryLockDocument(ctx context.Context, url string) (DocumentLock, error)
+
+	// SaveVersion keeps a fetched revision of the document. Saving the same
+	// (url, fetch time) pair again is a no-op.
+	SaveVersion(ctx context.Context, doc *model.Document) error
+	// ListVersions returns all kept revisions of the document ordered by fetch time.
+	ListVersions(ctx context.Context, url string) ([]*model.Document, error)
+	// GetVersionAt returns the latest revision fetched not later than fetchTime.
+	GetVersionAt(ctx context.Context, url string, fetchTime uint64) (*model.Document, error)
 }
@@ -0,0 +1,377 @@
+// Package repositorytest is a conformance test suite that every
+// repository.Repository implementation runs from its own tests.
+package repositorytest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"vk/pkg/model"
+	"vk/pkg/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns a new empty repository configured with opts.
+type Factory func(t *testing.T, opts ...repository.Option) repository.Repository
+
+// Run runs every conformance test against repositories made by newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newRepo Factory)
+	}{
+		{"SaveDocument", testSaveDocument},
+		{"GetDocument_NotFound", testGetDocumentNotFound},
+		{"SaveDocumentIfVersion", testSaveDocumentIfVersion},
+		{"Versions", testVersions},
+		{"LockDocument", testLockDocument},
+		{"LockDocument_Cancelled", testLockDocumentCancelled},
+		{"LockDocument_Timeout", testLockDocumentTimeout},
+		{"TryLockDocument", testTryLockDocument},
+		{"Unlock_NotHeld", testUnlockNotHeld},
+		{"ConcurrentMerges", testConcurrentMerges},
+		{"ConcurrentVersionConflicts", testConcurrentVersionConflicts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo)
+		})
+	}
+}
+
+func newDocument() *model.Document {
+	return &model.Document{
+		Url:            "http://example.com",
+		PubDate:        123456789,
+		FetchTime:      12346789,
+		Text:           "example content",
+		FirstFetchTime: 12346789,
+		OriginalUrl:    "http://Example.com/?utm_source=test",
+	}
+}
+
+func testSaveDocument(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	err := repo.SaveDocument(ctx, doc)
+	assert.NoError(t, err, "expected no error saving document")
+	assert.Equal(t, uint64(1), doc.Version, "expected the first version")
+
+	savedDoc, err := repo.GetDocument(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, doc, savedDoc, "expected to get the saved document")
+
+	doc.Text = "updated content"
+	err = repo.SaveDocument(ctx, doc)
+	assert.NoError(t, err, "expected no error saving document again")
+	assert.Equal(t, uint64(2), doc.Version, "expected the version to be bumped")
+
+	savedDoc, err = repo.GetDocument(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, doc, savedDoc, "expected to get the updated document")
+
+	doc.Provenance = model.Provenance{model.FieldText: doc.FetchTime, model.FieldPubDate: doc.FirstFetchTime}
+	err = repo.SaveDocument(ctx, doc)
+	assert.NoError(t, err, "expected no error saving document with provenance")
+
+	savedDoc, err = repo.GetDocument(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, doc, savedDoc, "expected to get the document provenance")
+
+	savedDoc.Text = "changed by caller"
+	savedDoc.Provenance[model.FieldText] = 0
+	savedDoc, err = repo.GetDocument(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, doc, savedDoc, "expected changes to a returned document not to be stored")
+}
+
+func testGetDocumentNotFound(t *testing.T, newRepo Factory) {
+	repo := newRepo(t)
+
+	_, err := repo.GetDocument(context.Background(), "http://notfound.com")
+	assert.Equal(t, repository.ErrDocumentNotFound, err, "expected 'document not found' error")
+}
+
+func testSaveDocumentIfVersion(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	err := repo.SaveDocumentIfVersion(ctx, doc, 0)
+	assert.NoError(t, err, "expected no error creating document")
+	assert.Equal(t, uint64(1), doc.Version, "expected the first version")
+
+	err = repo.SaveDocumentIfVersion(ctx, doc, 0)
+	var conflict *repository.VersionConflictError
+	assert.ErrorAs(t, err, &conflict, "expected conflict creating existing document")
+	assert.ErrorIs(t, err, repository.ErrVersionConflict)
+
+	doc.Text = "second content"
+	err = repo.SaveDocumentIfVersion(ctx, doc, 1)
+	assert.NoError(t, err, "expected no error updating document")
+	assert.Equal(t, uint64(2), doc.Version, "expected the version to be bumped")
+
+	err = repo.SaveDocumentIfVersion(ctx, doc, 1)
+	assert.ErrorIs(t, err, repository.ErrVersionConflict, "expected conflict updating stale version")
+	assert.Equal(t, uint64(2), doc.Version, "expected a failed save not to change the version")
+
+	savedDoc, err := repo.GetDocument(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, doc, savedDoc, "expected to get the last saved document")
+}
+
+func testVersions(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	first := *doc
+	first.FetchTime = doc.FetchTime + 10
+	first.Text = "first version"
+
+	second := *doc
+	second.FetchTime = doc.FetchTime + 20
+	second.Text = "second version"
+
+	assert.NoError(t, repo.SaveVersion(ctx, &second), "expected no error saving version")
+	assert.NoError(t, repo.SaveVersion(ctx, &first), "expected no error saving version")
+
+	duplicate := first
+	duplicate.Text = "duplicate version"
+	assert.NoError(t, repo.SaveVersion(ctx, &duplicate), "expected no error saving the same version again")
+
+	versions, err := repo.ListVersions(ctx, doc.Url)
+	assert.NoError(t, err, "expected no error listing versions")
+	assert.Equal(t, []*model.Document{&first, &second}, versions, "expected versions ordered by fetch time")
+
+	version, err := repo.GetVersionAt(ctx, doc.Url, second.FetchTime-1)
+	assert.NoError(t, err, "expected no error getting version")
+	assert.Equal(t, &first, version, "expected the version fetched before the given time")
+
+	version, err = repo.GetVersionAt(ctx, doc.Url, second.FetchTime)
+	assert.NoError(t, err, "expected no error getting version")
+	assert.Equal(t, &second, version, "expected the version fetched at the given time")
+
+	version, err = repo.GetVersionAt(ctx, doc.Url, second.FetchTime+1000)
+	assert.NoError(t, err, "expected no error getting version")
+	assert.Equal(t, &second, version, "expected the latest version")
+
+	_, err = repo.GetVersionAt(ctx, doc.Url, first.FetchTime-1)
+	assert.Equal(t, repository.ErrVersionNotFound, err, "expected 'version not found' error")
+
+	versions, err = repo.ListVersions(ctx, "http://notfound.com")
+	assert.NoError(t, err, "expected no error listing versions of not found document")
+	assert.Empty(t, versions, "expected no versions of not found document")
+}
+
+func testLockDocument(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	gorutinesCount := 3
+	sleepTime := time.Millisecond * 200
+	expectedWorkDuration := sleepTime * time.Duration(gorutinesCount)
+
+	wg := sync.WaitGroup{}
+	wg.Add(gorutinesCount)
+
+	startTime := time.Now()
+
+	for idx := 0; idx < gorutinesCount; idx++ {
+		go func() {
+			defer wg.Done()
+			lock, err := repo.LockDocument(ctx, doc.Url)
+			if !assert.NoError(t, err, "expected no error locking document again") {
+				return
+			}
+			<-time.After(sleepTime)
+			lock.Unlock(ctx)
+		}()
+	}
+
+	wg.Wait()
+
+	workDuration := time.Since(startTime)
+	assert.GreaterOrEqual(
+		t, workDuration, expectedWorkDuration,
+		"expected total work duration to be at least %v, got %v",
+		expectedWorkDuration, workDuration,
+	)
+}
+
+func testLockDocumentCancelled(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	lock, err := repo.LockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected no error locking document")
+	defer lock.Unlock(ctx)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	_, err = repo.LockDocument(timeoutCtx, doc.Url)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "expected locked document wait to be cancelled")
+}
+
+func testLockDocumentTimeout(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t, repository.WithLockTimeout(100*time.Millisecond))
+	doc := newDocument()
+
+	lock, err := repo.LockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected no error locking document")
+	defer lock.Unlock(ctx)
+
+	startTime := time.Now()
+	_, err = repo.LockDocument(ctx, doc.Url)
+	assert.Equal(t, repository.ErrLockTimeout, err, "expected 'document lock timeout' error")
+	assert.GreaterOrEqual(t, time.Since(startTime), 100*time.Millisecond, "expected to wait for the timeout")
+}
+
+func testTryLockDocument(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	lock, err := repo.TryLockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected no error locking free document")
+
+	_, err = repo.TryLockDocument(ctx, doc.Url)
+	assert.Equal(t, repository.ErrLockBusy, err, "expected 'document is locked' error")
+
+	otherLock, err := repo.TryLockDocument(ctx, "http://example.com/other")
+	require.NoError(t, err, "expected other documents to stay unlocked")
+	otherLock.Unlock(ctx)
+
+	err = lock.Unlock(ctx)
+	assert.NoError(t, err, "expected no error unlocking document")
+
+	lock, err = repo.TryLockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected no error locking released document")
+	lock.Unlock(ctx)
+}
+
+func testUnlockNotHeld(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	doc := newDocument()
+
+	lock, err := repo.LockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected no error locking document")
+
+	err = lock.Unlock(ctx)
+	assert.NoError(t, err, "expected no error unlocking document")
+
+	err = lock.Unlock(ctx)
+	assert.Equal(t, repository.ErrLockNotHeld, err, "expected 'lock is not held' error")
+
+	lock, err = repo.TryLockDocument(ctx, doc.Url)
+	require.NoError(t, err, "expected a second unlock not to break the lock")
+	lock.Unlock(ctx)
+}
+
+// testConcurrentMerges runs the processor's lock-get-merge-save cycle from
+// several goroutines and checks that no update is lost.
+func testConcurrentMerges(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	url := newDocument().Url
+
+	gorutinesCount := 10
+
+	wg := sync.WaitGroup{}
+	wg.Add(gorutinesCount)
+
+	for idx := 1; idx <= gorutinesCount; idx++ {
+		go func(idx int) {
+			defer wg.Done()
+
+			lock, err := repo.LockDocument(ctx, url)
+			if !assert.NoError(t, err, "expected no error locking document") {
+				return
+			}
+			defer lock.Unlock(ctx)
+
+			doc, err := repo.GetDocument(ctx, url)
+			if err == repository.ErrDocumentNotFound {
+				doc = &model.Document{Url: url, FirstFetchTime: uint64(idx)}
+			} else if !assert.NoError(t, err, "expected no error getting document") {
+				return
+			}
+
+			if uint64(idx) > doc.FetchTime {
+				doc.FetchTime = uint64(idx)
+				doc.Text = fmt.Sprintf("content %d", idx)
+			}
+			doc.FirstFetchTime = min(doc.FirstFetchTime, uint64(idx))
+
+			err = repo.SaveDocument(ctx, doc)
+			assert.NoError(t, err, "expected no error saving document")
+		}(idx)
+	}
+
+	wg.Wait()
+
+	doc, err := repo.GetDocument(ctx, url)
+	require.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, fmt.Sprintf("content %d", gorutinesCount), doc.Text, "expected the latest text to win")
+	assert.Equal(t, uint64(1), doc.FirstFetchTime, "expected the earliest fetch time to win")
+	assert.Equal(t, uint64(gorutinesCount), doc.Version, "expected every merge to be saved")
+}
+
+// testConcurrentVersionConflicts has several goroutines update one document
+// with SaveDocumentIfVersion and retry on conflict.
+func testConcurrentVersionConflicts(t *testing.T, newRepo Factory) {
+	ctx := context.Background()
+	repo := newRepo(t)
+	url := newDocument().Url
+
+	gorutinesCount := 10
+
+	wg := sync.WaitGroup{}
+	wg.Add(gorutinesCount)
+
+	for idx := 0; idx < gorutinesCount; idx++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				doc, err := repo.GetDocument(ctx, url)
+				if err == repository.ErrDocumentNotFound {
+					doc = &model.Document{Url: url}
+				} else if !assert.NoError(t, err, "expected no error getting document") {
+					return
+				}
+
+				expected := doc.Version
+				doc.FetchTime++
+
+				err = repo.SaveDocumentIfVersion(ctx, doc, expected)
+				if err == nil {
+					return
+				}
+				if !assert.ErrorIs(t, err, repository.ErrVersionConflict, "expected only version conflicts") {
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	doc, err := repo.GetDocument(ctx, url)
+	require.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, uint64(gorutinesCount), doc.FetchTime, "expected no update to be lost")
+	assert.Equal(t, uint64(gorutinesCount), doc.Version, "expected every update to bump the version")
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+
+	"vk/pkg/model"
+)
+
+// ShardedInMemoryRepository splits documents between several InMemoryRepository
+// shards by URL hash, so that goroutines working on different documents rarely
+// contend on the same data map or lock table.
+type ShardedInMemoryRepository struct {
+	shards []*InMemoryRepository
+}
+
+func NewShardedInMemoryRepository(shardCount int, opts ...Option) *ShardedInMemoryRepository {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	shards := make([]*InMemoryRepository, shardCount)
+	for idx := range shards {
+		shards[idx] = NewInMemoryRepository(opts...)
+	}
+	return &ShardedInMemoryRepository{shards: shards}
+}
+
+func (repo *ShardedInMemoryRepository) shard(url string) *InMemoryRepository {
+	// FNV-1a, inlined to avoid allocating a hash.Hash per call
+	hash := uint32(2166136261)
+	for idx := 0; idx < len(url); idx++ {
+		hash ^= uint32(url[idx])
+		hash *= 16777619
+	}
+	return repo.shards[hash%uint32(len(repo.shards))]
+}
+
+func (repo *ShardedInMemoryRepository) GetDocument(ctx context.Context, url string) (*model.Document, error) {
+	return repo.shard(url).GetDocument(ctx, url)
+}
+
+func (repo *ShardedInMemoryRepository) SaveDocument(ctx context.Context, doc *model.Document) error {
+	return repo.shard(doc.Url).SaveDocument(ctx, doc)
+}
+
+func (repo *ShardedInMemoryRepository) SaveDocumentIfVersion(ctx context.Context, doc *model.Document, expected uint64) error {
+	return repo.shard(doc.Url).SaveDocumentIfVersion(ctx, doc, expected)
+}
+
+func (repo *ShardedInMemoryRepository) SaveVersion(ctx context.Context, doc *model.Document) error {
+	return repo.shard(doc.Url).SaveVersion(ctx, doc)
+}
+
+func (repo *ShardedInMemoryRepository) ListVersions(ctx context.Context, url string) ([]*model.Document, error) {
+	return repo.shard(url).ListVersions(ctx, url)
+}
+
+func (repo *ShardedInMemoryRepository) GetVersionAt(ctx context.Context, url string, fetchTime uint64) (*model.Document, error) {
+	return repo.shard(url).GetVersionAt(ctx, url, fetchTime)
+}
+
+func (repo *ShardedInMemoryRepository) LockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	return repo.shard(url).LockDocument(ctx, url)
+}
+
+func (repo *ShardedInMemoryRepository) TryLockDocument(ctx context.Context, url string) (DocumentLock, error) {
+	return repo.shard(url).TryLockDocument(ctx, url)
+}
@@ -0,0 +1,66 @@
+package repository_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"vk/pkg/model"
+	"vk/pkg/repository"
+	"vk/pkg/repository/repositorytest"
+)
+
+func TestShardedInMemoryRepository(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		return repository.NewShardedInMemoryRepository(8, opts...)
+	})
+}
+
+// BenchmarkRepository_ParallelProcess runs the processor's lock-get-save-unlock
+// cycle from parallel goroutines on random URLs:
+//
+//	go test -run '^$' -bench ParallelProcess -cpu 1,8,32 ./pkg/repository
+func BenchmarkRepository_ParallelProcess(b *testing.B) {
+	repos := []struct {
+		name string
+		repo repository.Repository
+	}{
+		{"InMemory", repository.NewInMemoryRepository()},
+		{"ShardedInMemory_16", repository.NewShardedInMemoryRepository(16)},
+		{"ShardedInMemory_64", repository.NewShardedInMemoryRepository(64)},
+	}
+
+	urls := make([]string, 10000)
+	for idx := range urls {
+		urls[idx] = fmt.Sprintf("http://example.com/%d", idx)
+	}
+
+	for _, r := range repos {
+		b.Run(r.name, func(b *testing.B) {
+			ctx := context.Background()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					url := urls[rand.N(len(urls))]
+
+					lock, err := r.repo.LockDocument(ctx, url)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					doc, err := r.repo.GetDocument(ctx, url)
+					if err != nil {
+						doc = &model.Document{Url: url}
+					}
+					doc.FetchTime++
+
+					if err := r.repo.SaveDocument(ctx, doc); err != nil {
+						b.Fatal(err)
+					}
+					lock.Unlock(ctx)
+				}
+			})
+		})
+	}
+}
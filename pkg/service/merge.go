@@ -0,0 +1,210 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+
+	"vk/pkg/model"
+)
+
+const (
+	MergeLatestText   = "latest"
+	MergeLongestText  = "longest-text"
+	MergeNonEmptyText = "non-empty-text"
+)
+
+// MergeStrategy merges an incoming document into the stored one. existingDoc
+// is nil for a document seen for the first time; otherwise it may be updated
+// in place and returned.
+type MergeStrategy interface {
+	Merge(existingDoc, newDoc *model.Document) *model.Document
+}
+
+// MergeFunc adapts a function to MergeStrategy.
+type MergeFunc func(existingDoc, newDoc *model.Document) *model.Document
+
+func (f MergeFunc) Merge(existingDoc, newDoc *model.Document) *model.Document {
+	return f(existingDoc, newDoc)
+}
+
+// DefaultMergeStrategy takes Text from the latest fetch and PubDate from the
+// earliest one.
+var DefaultMergeStrategy MergeStrategy = defaultFieldRules
+
+var defaultFieldRules = FieldRules{
+	model.FieldText:    LatestWins,
+	model.FieldPubDate: EarliestWins,
+}
+
+// LongestTextMergeStrategy keeps the longest Text seen so far, preferring
+// the latest fetch on a tie. PubDate is taken from the earliest fetch.
+var LongestTextMergeStrategy MergeStrategy = FieldRules{
+	model.FieldText:    MaxWins,
+	model.FieldPubDate: EarliestWins,
+}
+
+// NonEmptyTextMergeStrategy works as DefaultMergeStrategy but never replaces
+// a non-empty Text with an empty one.
+var NonEmptyTextMergeStrategy MergeStrategy = FieldRules{
+	model.FieldText:    LatestNonEmptyWins,
+	model.FieldPubDate: EarliestWins,
+}
+
+// MergeStrategyByName returns one of the built-in strategies by its config name.
+func MergeStrategyByName(name string) (MergeStrategy, error) {
+	switch name {
+	case MergeLatestText:
+		return DefaultMergeStrategy, nil
+	case MergeLongestText:
+		return LongestTextMergeStrategy, nil
+	case MergeNonEmptyText:
+		return NonEmptyTextMergeStrategy, nil
+	default:
+		return nil, fmt.Errorf("unknown merge strategy: %s", name)
+	}
+}
+
+// FieldRule decides whether the incoming value of a field replaces the stored one.
+type FieldRule int
+
+const (
+	// LatestWins takes the value from the latest fetch.
+	LatestWins FieldRule = iota
+	// EarliestWins takes the value from the earliest fetch.
+	EarliestWins
+	// MaxWins takes the greatest value; texts are compared by length. On a
+	// tie the value from the latest fetch is taken.
+	MaxWins
+	// MinWins takes the smallest value; texts are compared by length. On a
+	// tie the value from the latest fetch is taken.
+	MinWins
+	// FirstNonEmptyWins takes the non-empty value from the earliest fetch.
+	FirstNonEmptyWins
+	// LatestNonEmptyWins takes the non-empty value from the latest fetch.
+	LatestNonEmptyWins
+)
+
+var fieldRuleNames = map[string]FieldRule{
+	"latest":           LatestWins,
+	"earliest":         EarliestWins,
+	"max":              MaxWins,
+	"min":              MinWins,
+	"first-non-empty":  FirstNonEmptyWins,
+	"latest-non-empty": LatestNonEmptyWins,
+}
+
+// FieldRules is a MergeStrategy that merges every field by its own rule and
+// records in the document Provenance the FetchTime of the message that set
+// each field. Fields without a rule follow DefaultMergeStrategy.
+type FieldRules map[string]FieldRule
+
+// ParseFieldRules parses rules like "Text=max,PubDate=earliest".
+func ParseFieldRules(spec string) (FieldRules, error) {
+	rules := FieldRules{}
+	for _, item := range strings.Split(spec, ",") {
+		name, ruleName, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid field rule: %q", item)
+		}
+		if _, exists := documentFields[name]; !exists {
+			return nil, fmt.Errorf("unknown document field: %s", name)
+		}
+
+		rule, exists := fieldRuleNames[ruleName]
+		if !exists {
+			return nil, fmt.Errorf("unknown field rule: %s", ruleName)
+		}
+		rules[name] = rule
+	}
+	return rules, nil
+}
+
+func (r FieldRules) Merge(existingDoc, newDoc *model.Document) *model.Document {
+	if existingDoc == nil {
+		existingDoc = &model.Document{
+			Url:            newDoc.Url,
+			PubDate:        newDoc.PubDate,
+			FetchTime:      newDoc.FetchTime,
+			Text:           newDoc.Text,
+			FirstFetchTime: newDoc.FetchTime,
+			Provenance:     model.Provenance{},
+			OriginalUrl:    newDoc.OriginalUrl,
+		}
+		for name := range documentFields {
+			existingDoc.Provenance[name] = newDoc.FetchTime
+		}
+		return existingDoc
+	}
+
+	provenance := model.Provenance{}
+	for name, field := range documentFields {
+		setAt, exists := existingDoc.Provenance[name]
+		if !exists {
+			setAt = field.setAt(existingDoc)
+		}
+
+		rule, exists := r[name]
+		if !exists {
+			rule = defaultFieldRules[name]
+		}
+
+		if rule.replace(field, existingDoc, newDoc, setAt) {
+			field.copy(existingDoc, newDoc)
+			setAt = newDoc.FetchTime
+		}
+		provenance[name] = setAt
+	}
+	existingDoc.Provenance = provenance
+
+	if newDoc.FetchTime > existingDoc.FetchTime {
+		existingDoc.FetchTime = newDoc.FetchTime
+	}
+
+	if newDoc.FetchTime < existingDoc.FirstFetchTime {
+		existingDoc.FirstFetchTime = newDoc.FetchTime
+	}
+
+	return existingDoc
+}
+
+func (rule FieldRule) replace(field documentField, existingDoc, newDoc *model.Document, setAt uint64) bool {
+	switch rule {
+	case LatestWins:
+		return newDoc.FetchTime > setAt
+	case EarliestWins:
+		return newDoc.FetchTime < setAt
+	case MaxWins:
+		return field.less(existingDoc, newDoc) || (!field.less(newDoc, existingDoc) && newDoc.FetchTime > setAt)
+	case MinWins:
+		return field.less(newDoc, existingDoc) || (!field.less(existingDoc, newDoc) && newDoc.FetchTime > setAt)
+	case FirstNonEmptyWins:
+		return !field.empty(newDoc) && (field.empty(existingDoc) || newDoc.FetchTime < setAt)
+	case LatestNonEmptyWins:
+		return !field.empty(newDoc) && (field.empty(existingDoc) || newDoc.FetchTime > setAt)
+	default:
+		return false
+	}
+}
+
+type documentField struct {
+	// setAt is the fetch time of a stored value without provenance.
+	setAt func(d *model.Document) uint64
+	empty func(d *model.Document) bool
+	less  func(a, b *model.Document) bool
+	copy  func(dst, src *model.Document)
+}
+
+var documentFields = map[string]documentField{
+	model.FieldText: {
+		setAt: func(d *model.Document) uint64 { return d.FetchTime },
+		empty: func(d *model.Document) bool { return d.Text == "" },
+		less:  func(a, b *model.Document) bool { return len(a.Text) < len(b.Text) },
+		copy:  func(dst, src *model.Document) { dst.Text = src.Text },
+	},
+	model.FieldPubDate: {
+		setAt: func(d *model.Document) uint64 { return d.FirstFetchTime },
+		empty: func(d *model.Document) bool { return d.PubDate == 0 },
+		less:  func(a, b *model.Document) bool { return a.PubDate < b.PubDate },
+		copy:  func(dst, src *model.Document) { dst.PubDate = src.PubDate },
+	},
+}
@@ -0,0 +1,164 @@
+package processor
+
+import (
+	"testing"
+
+	"vk/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeStrategies(t *testing.T) {
+	url := "http://example.com"
+
+	provenance := func(text, pubDate uint64) model.Provenance {
+		return model.Provenance{model.FieldText: text, model.FieldPubDate: pubDate}
+	}
+
+	existing := func() *model.Document {
+		return &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "stored content", FirstFetchTime: 100}
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		existing *model.Document
+		incoming *model.Document
+		expected *model.Document
+	}{
+		{
+			name:     "Latest_NewDocument",
+			strategy: MergeLatestText,
+			existing: nil,
+			incoming: &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "content"},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "content", FirstFetchTime: 200, Provenance: provenance(200, 200)},
+		},
+		{
+			name:     "Latest_NewerFetch",
+			strategy: MergeLatestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: "new"},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "new", FirstFetchTime: 100, Provenance: provenance(300, 100)},
+		},
+		{
+			name:     "Latest_OlderFetch",
+			strategy: MergeLatestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 5, FetchTime: 50, Text: "old"},
+			expected: &model.Document{Url: url, PubDate: 5, FetchTime: 200, Text: "stored content", FirstFetchTime: 50, Provenance: provenance(200, 50)},
+		},
+		{
+			name:     "LongestText_NewerShorter",
+			strategy: MergeLongestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: "short"},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "stored content", FirstFetchTime: 100, Provenance: provenance(200, 100)},
+		},
+		{
+			name:     "LongestText_OlderLonger",
+			strategy: MergeLongestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 5, FetchTime: 50, Text: "much longer stored content"},
+			expected: &model.Document{Url: url, PubDate: 5, FetchTime: 200, Text: "much longer stored content", FirstFetchTime: 50, Provenance: provenance(50, 50)},
+		},
+		{
+			name:     "LongestText_NewerSameLength",
+			strategy: MergeLongestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: "stored-content"},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "stored-content", FirstFetchTime: 100, Provenance: provenance(300, 100)},
+		},
+		{
+			name:     "LongestText_OlderSameLength",
+			strategy: MergeLongestText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 5, FetchTime: 50, Text: "older content!"},
+			expected: &model.Document{Url: url, PubDate: 5, FetchTime: 200, Text: "stored content", FirstFetchTime: 50, Provenance: provenance(200, 50)},
+		},
+		{
+			name:     "NonEmptyText_NewerEmpty",
+			strategy: MergeNonEmptyText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: ""},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "stored content", FirstFetchTime: 100, Provenance: provenance(200, 100)},
+		},
+		{
+			name:     "NonEmptyText_NewerNonEmpty",
+			strategy: MergeNonEmptyText,
+			existing: existing(),
+			incoming: &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: "new"},
+			expected: &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "new", FirstFetchTime: 100, Provenance: provenance(300, 100)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := MergeStrategyByName(tt.strategy)
+			assert.NoError(t, err, "expected known merge strategy")
+
+			result := strategy.Merge(tt.existing, tt.incoming)
+			assert.Equal(t, tt.expected, result, "expected the merged document")
+		})
+	}
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := MergeStrategyByName("unknown")
+		assert.Error(t, err, "expected error for unknown merge strategy")
+	})
+}
+
+func TestFieldRules(t *testing.T) {
+	url := "http://example.com"
+
+	t.Run("OutOfOrderFetches", func(t *testing.T) {
+		rules := FieldRules{model.FieldText: LatestWins, model.FieldPubDate: EarliestWins}
+
+		doc := rules.Merge(nil, &model.Document{Url: url, PubDate: 20, FetchTime: 200, Text: "second"})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 30, FetchTime: 300, Text: "third"})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 10, FetchTime: 100, Text: "first"})
+
+		expected := &model.Document{
+			Url:            url,
+			PubDate:        10,
+			FetchTime:      300,
+			Text:           "third",
+			FirstFetchTime: 100,
+			Provenance:     model.Provenance{model.FieldText: 300, model.FieldPubDate: 100},
+		}
+		assert.Equal(t, expected, doc, "expected every field to come from the fetch its rule selects")
+	})
+
+	t.Run("FirstNonEmptyWins", func(t *testing.T) {
+		rules := FieldRules{model.FieldText: FirstNonEmptyWins, model.FieldPubDate: MinWins}
+
+		doc := rules.Merge(nil, &model.Document{Url: url, PubDate: 20, FetchTime: 200})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 30, FetchTime: 300, Text: "third"})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 10, FetchTime: 250, Text: "second"})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 40, FetchTime: 100})
+
+		assert.Equal(t, "second", doc.Text, "expected the earliest non-empty text")
+		assert.Equal(t, uint64(10), doc.PubDate, "expected the minimal pub date")
+		assert.Equal(t, model.Provenance{model.FieldText: 250, model.FieldPubDate: 250}, doc.Provenance)
+	})
+
+	t.Run("MissingRule", func(t *testing.T) {
+		rules := FieldRules{model.FieldText: MaxWins}
+
+		doc := rules.Merge(nil, &model.Document{Url: url, PubDate: 20, FetchTime: 200, Text: "content"})
+		doc = rules.Merge(doc, &model.Document{Url: url, PubDate: 10, FetchTime: 100, Text: "text"})
+
+		assert.Equal(t, "content", doc.Text, "expected the longest text")
+		assert.Equal(t, uint64(10), doc.PubDate, "expected the default rule for pub date")
+	})
+}
+
+func TestParseFieldRules(t *testing.T) {
+	rules, err := ParseFieldRules("Text=latest-non-empty, PubDate=earliest")
+	assert.NoError(t, err, "expected no error parsing field rules")
+	assert.Equal(t, FieldRules{model.FieldText: LatestNonEmptyWins, model.FieldPubDate: EarliestWins}, rules)
+
+	for _, spec := range []string{"Text", "Title=latest", "Text=newest"} {
+		_, err := ParseFieldRules(spec)
+		assert.Error(t, err, "expected error parsing %q", spec)
+	}
+}
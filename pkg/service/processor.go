@@ -1,67 +1,295 @@
 package processor
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"strconv"
 
+	"vk/pkg/diff"
 	"vk/pkg/model"
 	"vk/pkg/repository"
 )
 
 type Processor interface {
-	Process(d *model.Document) (*model.Document, error)
+	Process(ctx context.Context, d *model.Document) (*Result, error)
+}
+
+// Change describes how processing a message changed the stored document.
+// Zero value means the message changed nothing.
+type Change uint8
+
+const (
+	ChangeNew Change = 1 << iota
+	ChangeText
+	ChangePubDate
+	// ChangeRedelivered marks a message that had been saved before, e.g. by
+	// a run that crashed before its results were written. The change it made
+	// is unknown, Result holds the stored document.
+	ChangeRedelivered
+
+	ChangeNone Change = 0
+)
+
+func (c Change) String() string {
+	switch {
+	case c == ChangeNone:
+		return "no-op"
+	case c == ChangeRedelivered:
+		return "redelivered"
+	case c&ChangeNew != 0:
+		return "new"
+	case c == ChangeText:
+		return "updated-text"
+	case c == ChangePubDate:
+		return "updated-pubdate"
+	default:
+		return "updated-text,updated-pubdate"
+	}
+}
+
+// Result is the merged document together with its change report.
+type Result struct {
+	Document *model.Document
+	// Previous is the stored document before the merge, nil for a new one.
+	Previous *model.Document
+	Change   Change
+	// Diff lists the changed fields, nil when nothing changed.
+	Diff *model.DocumentChange
+}
+
+// changeOf compares the merged document with the stored one.
+func changeOf(previous, updated *model.Document) Change {
+	if previous == nil {
+		return ChangeNew
+	}
+
+	change := ChangeNone
+	if previous.Text != updated.Text {
+		change |= ChangeText
+	}
+	if previous.PubDate != updated.PubDate {
+		change |= ChangePubDate
+	}
+	return change
+}
+
+// modified reports whether the merged document has to be saved. A merge that
+// changed neither Text nor PubDate may still move fetch times and provenance,
+// which later merges of older messages rely on.
+func modified(previous, updated *model.Document) bool {
+	return changeOf(previous, updated) != ChangeNone ||
+		previous.FetchTime != updated.FetchTime ||
+		previous.FirstFetchTime != updated.FirstFetchTime ||
+		previous.OriginalUrl != updated.OriginalUrl ||
+		!maps.Equal(previous.Provenance, updated.Provenance)
+}
+
+func newResult(d, previous, updated *model.Document) *Result {
+	result := &Result{Document: updated, Previous: previous, Change: changeOf(previous, updated)}
+	if result.Change == ChangeNone {
+		return result
+	}
+
+	// a new document is diffed against an empty one
+	var prev model.Document
+	if previous != nil {
+		prev = *previous
+	}
+	textChanged := prev.Text != updated.Text
+	pubDateChanged := prev.PubDate != updated.PubDate
+
+	result.Diff = &model.DocumentChange{
+		Url:       updated.Url,
+		FetchTime: d.FetchTime,
+		Version:   updated.Version,
+		New:       previous == nil,
+	}
+	if textChanged {
+		result.Diff.Fields = append(result.Diff.Fields, model.FieldChange{
+			Field:    model.FieldText,
+			OldValue: prev.Text,
+			NewValue: updated.Text,
+		})
+		result.Diff.TextDiff = diff.Unified(
+			fmt.Sprintf("%s (version %d)", updated.Url, prev.Version),
+			fmt.Sprintf("%s (version %d)", updated.Url, updated.Version),
+			prev.Text, updated.Text)
+	}
+	if pubDateChanged {
+		result.Diff.Fields = append(result.Diff.Fields, model.FieldChange{
+			Field:    model.FieldPubDate,
+			OldValue: formatPubDate(previous),
+			NewValue: strconv.FormatUint(updated.PubDate, 10),
+		})
+	}
+	return result
+}
+
+func formatPubDate(doc *model.Document) string {
+	if doc == nil {
+		return ""
+	}
+	return strconv.FormatUint(doc.PubDate, 10)
+}
+
+// Changed reports whether the document content was changed.
+func (r *Result) Changed() bool {
+	return r.Change != ChangeNone
+}
+
+// URLNormalizer brings a document url to the canonical form.
+type URLNormalizer interface {
+	Normalize(url string) (string, error)
 }
 
 type processorImpl struct {
-	repo repository.Repository
+	repo       repository.Repository
+	merge      MergeStrategy
+	normalizer URLNormalizer
+
+	optimistic bool
+	maxRetries int
+}
+
+type Option func(*processorImpl)
+
+// WithOptimisticLocking makes the processor save documents with a version
+// check instead of locking them. On a version conflict the read-merge-write
+// loop is retried up to maxRetries times.
+func WithOptimisticLocking(maxRetries int) Option {
+	return func(p *processorImpl) {
+		p.optimistic = true
+		p.maxRetries = maxRetries
+	}
+}
+
+// WithMergeStrategy replaces DefaultMergeStrategy.
+func WithMergeStrategy(merge MergeStrategy) Option {
+	return func(p *processorImpl) {
+		p.merge = merge
+	}
+}
+
+// WithURLNormalizer makes the processor lock and store documents by the
+// normalized url. The url from the message is kept in OriginalUrl.
+func WithURLNormalizer(normalizer URLNormalizer) Option {
+	return func(p *processorImpl) {
+		p.normalizer = normalizer
+	}
 }
 
-func NewProcessor(repo repository.Repository) Processor {
-	return &processorImpl{repo: repo}
+func NewProcessor(repo repository.Repository, opts ...Option) Processor {
+	p := &processorImpl{repo: repo, merge: DefaultMergeStrategy}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
-func (p *processorImpl) Process(d *model.Document) (*model.Document, error) {
+func (p *processorImpl) Process(ctx context.Context, d *model.Document) (*Result, error) {
+	if p.normalizer != nil {
+		url, err := p.normalizer.Normalize(d.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		d = d.Copy()
+		d.OriginalUrl = d.Url
+		d.Url = url
+	}
+
+	if p.optimistic {
+		return p.processOptimistic(ctx, d)
+	}
 
 	// Lock the document
-	if err := p.repo.LockDocument(d.Url); err != nil {
+	lock, err := p.repo.LockDocument(ctx, d.Url)
+	if err != nil {
 		return nil, err
 	}
-	defer p.repo.UnlockDocument(d.Url)
+	defer lock.Unlock(context.WithoutCancel(ctx))
 
-	existingDoc, err := p.repo.GetDocument(d.Url)
+	existingDoc, err := p.repo.GetDocument(ctx, d.Url)
 	if err != nil && !errors.Is(err, repository.ErrDocumentNotFound) {
 		return nil, err
 	}
 
-	updatedDoc := mergeDocuments(existingDoc, d)
-
-	if err := p.repo.SaveDocument(updatedDoc); err != nil {
+	if err := p.repo.SaveVersion(ctx, d); err != nil {
 		return nil, err
 	}
 
-	return updatedDoc, nil
+	previous := copyDocument(existingDoc)
+	updatedDoc := p.merge.Merge(existingDoc, d)
+
+	if !modified(previous, updatedDoc) {
+		return unchanged(previous), nil
+	}
+
+	if err := p.repo.SaveDocument(ctx, updatedDoc); err != nil {
+		return redelivered(previous, err)
+	}
+
+	return newResult(d, previous, updatedDoc), nil
 }
 
-func mergeDocuments(existingDoc, newDoc *model.Document) *model.Document {
-	if existingDoc == nil {
-		existingDoc = &model.Document{
-			Url:            newDoc.Url,
-			PubDate:        newDoc.PubDate,
-			FetchTime:      newDoc.FetchTime,
-			Text:           newDoc.Text,
-			FirstFetchTime: newDoc.FetchTime,
-		}
-		return existingDoc
+func (p *processorImpl) processOptimistic(ctx context.Context, d *model.Document) (*Result, error) {
+	if err := p.repo.SaveVersion(ctx, d); err != nil {
+		return nil, err
 	}
 
-	if newDoc.FetchTime > existingDoc.FetchTime {
-		existingDoc.Text = newDoc.Text
-		existingDoc.FetchTime = newDoc.FetchTime
+	for attempt := 0; ; attempt++ {
+		existingDoc, err := p.repo.GetDocument(ctx, d.Url)
+		if err != nil && !errors.Is(err, repository.ErrDocumentNotFound) {
+			return nil, err
+		}
+
+		var expected uint64
+		if existingDoc != nil {
+			expected = existingDoc.Version
+		}
+
+		previous := copyDocument(existingDoc)
+		updatedDoc := p.merge.Merge(existingDoc, d)
+
+		if !modified(previous, updatedDoc) {
+			return unchanged(previous), nil
+		}
+
+		err = p.repo.SaveDocumentIfVersion(ctx, updatedDoc, expected)
+		if err == nil {
+			return newResult(d, previous, updatedDoc), nil
+		}
+		if errors.Is(err, repository.ErrMessageProcessed) {
+			return redelivered(previous, err)
+		}
+		if !errors.Is(err, repository.ErrVersionConflict) || attempt >= p.maxRetries {
+			return nil, err
+		}
 	}
+}
 
-	if newDoc.FetchTime < existingDoc.FirstFetchTime {
-		existingDoc.PubDate = newDoc.PubDate
-		existingDoc.FirstFetchTime = newDoc.FetchTime
+// unchanged is the result of a message that changed nothing stored. The
+// document is not saved again, so that its version does not go up and
+// concurrent optimistic writers do not conflict with it.
+func unchanged(previous *model.Document) *Result {
+	return &Result{Document: previous, Previous: previous, Change: ChangeNone}
+}
+
+// redelivered turns ErrMessageProcessed into a result with the stored document.
+func redelivered(previous *model.Document, err error) (*Result, error) {
+	if !errors.Is(err, repository.ErrMessageProcessed) || previous == nil {
+		return nil, err
 	}
+	return &Result{Document: previous, Previous: previous, Change: ChangeRedelivered}, nil
+}
 
-	return existingDoc
+// copyDocument keeps the stored document, as merge strategies may update it
+// in place.
+func copyDocument(doc *model.Document) *model.Document {
+	if doc == nil {
+		return nil
+	}
+	return doc.Copy()
 }
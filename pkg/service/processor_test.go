@@ -1,12 +1,16 @@
 package processor
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"vk/pkg/model"
 	"vk/pkg/repository"
+	"vk/pkg/urlnorm"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -17,26 +21,68 @@ type MockRepository struct {
 	mock.Mock
 }
 
-func (m *MockRepository) GetDocument(url string) (*model.Document, error) {
-	args := m.Called(url)
+func (m *MockRepository) GetDocument(ctx context.Context, url string) (*model.Document, error) {
+	args := m.Called(ctx, url)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
 	return args.Get(0).(*model.Document), args.Error(1)
 }
 
-func (m *MockRepository) SaveDocument(doc *model.Document) error {
-	args := m.Called(doc)
+func (m *MockRepository) SaveDocument(ctx context.Context, doc *model.Document) error {
+	args := m.Called(ctx, doc)
 	return args.Error(0)
 }
 
-func (m *MockRepository) LockDocument(url string) error {
-	args := m.Called(url)
+func (m *MockRepository) SaveDocumentIfVersion(ctx context.Context, doc *model.Document, expected uint64) error {
+	args := m.Called(ctx, doc, expected)
 	return args.Error(0)
 }
 
-func (m *MockRepository) UnlockDocument(url string) error {
-	args := m.Called(url)
+func (m *MockRepository) SaveVersion(ctx context.Context, doc *model.Document) error {
+	args := m.Called(ctx, doc)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ListVersions(ctx context.Context, url string) ([]*model.Document, error) {
+	args := m.Called(ctx, url)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*model.Document), args.Error(1)
+}
+
+func (m *MockRepository) GetVersionAt(ctx context.Context, url string, fetchTime uint64) (*model.Document, error) {
+	args := m.Called(ctx, url, fetchTime)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Document), args.Error(1)
+}
+
+func (m *MockRepository) LockDocument(ctx context.Context, url string) (repository.DocumentLock, error) {
+	args := m.Called(ctx, url)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(repository.DocumentLock), args.Error(1)
+}
+
+func (m *MockRepository) TryLockDocument(ctx context.Context, url string) (repository.DocumentLock, error) {
+	args := m.Called(ctx, url)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(repository.DocumentLock), args.Error(1)
+}
+
+// MockLock acts as a mock implementation of the DocumentLock interface.
+type MockLock struct {
+	mock.Mock
+}
+
+func (m *MockLock) Unlock(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
 
@@ -58,20 +104,25 @@ func TestProcessor(t *testing.T) {
 			FetchTime:      doc.FetchTime,
 			Text:           doc.Text,
 			FirstFetchTime: doc.FetchTime,
+			Provenance:     model.Provenance{model.FieldText: doc.FetchTime, model.FieldPubDate: doc.FetchTime},
 		}
 
 		newDoc := doc
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(nil, repository.ErrDocumentNotFound)
-		mockRepo.On("SaveDocument", updatedDoc).Return(nil)
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(nil, repository.ErrDocumentNotFound)
+		mockRepo.On("SaveVersion", mock.Anything, &newDoc).Return(nil)
+		mockRepo.On("SaveDocument", mock.Anything, updatedDoc).Return(nil)
 
-		result, err := processor.Process(&newDoc)
+		result, err := processor.Process(context.Background(), &newDoc)
 		assert.NoError(t, err, "expected no error processing new document")
-		assert.Equal(t, updatedDoc, result, "expected the result to be the same as the new document")
+		assert.Equal(t, updatedDoc, result.Document, "expected the result to be the same as the new document")
+		assert.Equal(t, ChangeNew, result.Change, "expected the change report")
 
 		mockRepo.AssertExpectations(t)
+		mockLock.AssertExpectations(t)
 	})
 
 	mockRepo = new(MockRepository)
@@ -99,18 +150,23 @@ func TestProcessor(t *testing.T) {
 			FetchTime:      newDoc.FetchTime,
 			Text:           newDoc.Text,
 			FirstFetchTime: existingDoc.FetchTime,
+			Provenance:     model.Provenance{model.FieldText: newDoc.FetchTime, model.FieldPubDate: existingDoc.FirstFetchTime},
 		}
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(existingDoc, nil)
-		mockRepo.On("SaveDocument", updatedDoc).Return(nil)
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(existingDoc, nil)
+		mockRepo.On("SaveVersion", mock.Anything, newDoc).Return(nil)
+		mockRepo.On("SaveDocument", mock.Anything, updatedDoc).Return(nil)
 
-		result, err := processor.Process(newDoc)
+		result, err := processor.Process(context.Background(), newDoc)
 		assert.NoError(t, err, "expected no error updating document")
-		assert.Equal(t, updatedDoc, result, "expected the result to be the updated document")
+		assert.Equal(t, updatedDoc, result.Document, "expected the result to be the updated document")
+		assert.Equal(t, ChangeText, result.Change, "expected the change report")
 
 		mockRepo.AssertExpectations(t)
+		mockLock.AssertExpectations(t)
 	})
 
 	mockRepo = new(MockRepository)
@@ -138,46 +194,57 @@ func TestProcessor(t *testing.T) {
 			FetchTime:      existingDoc.FetchTime,
 			Text:           existingDoc.Text,
 			FirstFetchTime: newDoc.FetchTime,
+			Provenance:     model.Provenance{model.FieldText: existingDoc.FetchTime, model.FieldPubDate: newDoc.FetchTime},
 		}
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(existingDoc, nil)
-		mockRepo.On("SaveDocument", updatedDoc).Return(nil)
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(existingDoc, nil)
+		mockRepo.On("SaveVersion", mock.Anything, newDoc).Return(nil)
+		mockRepo.On("SaveDocument", mock.Anything, updatedDoc).Return(nil)
 
-		result, err := processor.Process(newDoc)
+		result, err := processor.Process(context.Background(), newDoc)
 		assert.NoError(t, err, "expected no error updating document")
-		assert.Equal(t, updatedDoc, result, "expected the result to be the updated document")
+		assert.Equal(t, updatedDoc, result.Document, "expected the result to be the updated document")
+		assert.Equal(t, ChangePubDate, result.Change, "expected the change report")
 
 		mockRepo.AssertExpectations(t)
+		mockLock.AssertExpectations(t)
 	})
 
 	mockRepo = new(MockRepository)
 	processor = NewProcessor(mockRepo)
 
 	t.Run("Process_UpdateCopycatDocument", func(t *testing.T) {
+		now := uint64(time.Now().Unix())
 		existingDoc := &model.Document{
 			Url:            doc.Url,
-			PubDate:        uint64(time.Now().Unix()),
-			FetchTime:      uint64(time.Now().Unix()),
+			PubDate:        now,
+			FetchTime:      now,
 			Text:           "old content",
-			FirstFetchTime: uint64(time.Now().Unix()),
+			FirstFetchTime: now,
+			Provenance:     model.Provenance{model.FieldText: now, model.FieldPubDate: now},
 		}
 
-		newDoc := existingDoc
+		newDoc := existingDoc.Copy()
 
-		updatedDoc := existingDoc
+		storedDoc := existingDoc.Copy()
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(existingDoc, nil)
-		mockRepo.On("SaveDocument", updatedDoc).Return(nil)
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(existingDoc, nil)
+		mockRepo.On("SaveVersion", mock.Anything, newDoc).Return(nil)
 
-		result, err := processor.Process(newDoc)
+		result, err := processor.Process(context.Background(), newDoc)
 		assert.NoError(t, err, "expected no error updating document")
-		assert.Equal(t, updatedDoc, result, "expected the result to be the updated document")
+		assert.Equal(t, storedDoc, result.Document, "expected the result to be the stored document")
+		assert.Equal(t, ChangeNone, result.Change, "expected the change report")
 
 		mockRepo.AssertExpectations(t)
+		mockRepo.AssertNotCalled(t, "SaveDocument", mock.Anything, mock.Anything)
+		mockLock.AssertExpectations(t)
 	})
 
 	mockRepo = new(MockRepository)
@@ -186,9 +253,9 @@ func TestProcessor(t *testing.T) {
 	t.Run("Process_LockFailure", func(t *testing.T) {
 		newDoc := doc
 
-		mockRepo.On("LockDocument", doc.Url).Return(errors.New("lock error"))
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(nil, errors.New("lock error"))
 
-		result, err := processor.Process(&newDoc)
+		result, err := processor.Process(context.Background(), &newDoc)
 		assert.Error(t, err)
 		assert.Nil(t, result, "expected nil result on lock failure")
 		assert.Equal(t, "lock error", err.Error(), "expected lock error")
@@ -206,21 +273,25 @@ func TestProcessor(t *testing.T) {
 			FetchTime:      doc.FetchTime,
 			Text:           doc.Text,
 			FirstFetchTime: doc.FetchTime,
+			Provenance:     model.Provenance{model.FieldText: doc.FetchTime, model.FieldPubDate: doc.FetchTime},
 		}
 
 		newDoc := doc
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(nil, repository.ErrDocumentNotFound)
-		mockRepo.On("SaveDocument", updatedDoc).Return(errors.New("save error"))
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(nil, repository.ErrDocumentNotFound)
+		mockRepo.On("SaveVersion", mock.Anything, &newDoc).Return(nil)
+		mockRepo.On("SaveDocument", mock.Anything, updatedDoc).Return(errors.New("save error"))
 
-		result, err := processor.Process(&newDoc)
+		result, err := processor.Process(context.Background(), &newDoc)
 		assert.Error(t, err)
 		assert.Nil(t, result, "expected nil result on save failure")
 		assert.Equal(t, "save error", err.Error(), "expected save error")
 
 		mockRepo.AssertExpectations(t)
+		mockLock.AssertExpectations(t)
 	})
 
 	mockRepo = new(MockRepository)
@@ -229,15 +300,311 @@ func TestProcessor(t *testing.T) {
 	t.Run("Process_GetFailure", func(t *testing.T) {
 		newDoc := doc
 
-		mockRepo.On("LockDocument", doc.Url).Return(nil)
-		mockRepo.On("UnlockDocument", doc.Url).Return(nil)
-		mockRepo.On("GetDocument", doc.Url).Return(nil, errors.New("get error"))
+		mockLock := new(MockLock)
+		mockLock.On("Unlock", mock.Anything).Return(nil)
+		mockRepo.On("LockDocument", mock.Anything, doc.Url).Return(mockLock, nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(nil, errors.New("get error"))
 
-		result, err := processor.Process(&newDoc)
+		result, err := processor.Process(context.Background(), &newDoc)
 		assert.Error(t, err)
 		assert.Nil(t, result, "expected nil result on get failure")
 		assert.Equal(t, "get error", err.Error(), "expected get error")
 
 		mockRepo.AssertExpectations(t)
+		mockLock.AssertExpectations(t)
 	})
 }
+
+func TestProcessor_KeepsVersions(t *testing.T) {
+	repo := repository.NewInMemoryRepository()
+	processor := NewProcessor(repo)
+
+	url := "http://example.com"
+	docs := []*model.Document{
+		{Url: url, PubDate: 10, FetchTime: 200, Text: "second"},
+		{Url: url, PubDate: 5, FetchTime: 100, Text: "first"},
+		{Url: url, PubDate: 20, FetchTime: 300, Text: "third"},
+		{Url: url, PubDate: 20, FetchTime: 300, Text: "third"},
+	}
+
+	for _, doc := range docs {
+		_, err := processor.Process(context.Background(), doc)
+		assert.NoError(t, err, "expected no error processing document")
+	}
+
+	current, err := repo.GetDocument(context.Background(), url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, "third", current.Text, "expected the latest text to win")
+
+	versions, err := repo.ListVersions(context.Background(), url)
+	assert.NoError(t, err, "expected no error listing versions")
+	assert.Len(t, versions, 3, "expected every distinct fetch to be kept")
+	assert.Equal(t, "first", versions[0].Text)
+	assert.Equal(t, "second", versions[1].Text)
+	assert.Equal(t, "third", versions[2].Text)
+
+	version, err := repo.GetVersionAt(context.Background(), url, 250)
+	assert.NoError(t, err, "expected no error getting version")
+	assert.Equal(t, "second", version.Text, "expected the version fetched before 250")
+
+	_, err = repo.GetVersionAt(context.Background(), url, 50)
+	assert.Equal(t, repository.ErrVersionNotFound, err, "expected no version before the first fetch")
+}
+
+func TestProcessor_OptimisticLocking(t *testing.T) {
+	doc := model.Document{
+		Url:       "http://example.com",
+		PubDate:   uint64(time.Now().Add(-time.Hour * 1).Unix()),
+		FetchTime: uint64(time.Now().Unix()),
+		Text:      "new content",
+	}
+
+	t.Run("Process_RetryOnConflict", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		processor := NewProcessor(mockRepo, WithOptimisticLocking(3))
+
+		existingDoc := &model.Document{
+			Url:            doc.Url,
+			PubDate:        doc.PubDate,
+			FetchTime:      doc.FetchTime - 10,
+			Text:           "old content",
+			FirstFetchTime: doc.FetchTime - 10,
+			Version:        3,
+		}
+		newDoc := doc
+
+		conflict := &repository.VersionConflictError{Url: doc.Url, Expected: 3}
+
+		mockRepo.On("SaveVersion", mock.Anything, &newDoc).Return(nil)
+		// merge updates the stored document in place, every read gets a fresh one
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(existingDoc.Copy(), nil).Once()
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(existingDoc.Copy(), nil).Once()
+		mockRepo.On("SaveDocumentIfVersion", mock.Anything, mock.Anything, uint64(3)).Return(conflict).Once()
+		mockRepo.On("SaveDocumentIfVersion", mock.Anything, mock.Anything, uint64(3)).Return(nil).Once()
+
+		result, err := processor.Process(context.Background(), &newDoc)
+		assert.NoError(t, err, "expected no error after retrying the conflict")
+		assert.Equal(t, doc.Text, result.Document.Text, "expected the newer text to win")
+
+		mockRepo.AssertExpectations(t)
+		mockRepo.AssertNumberOfCalls(t, "GetDocument", 2)
+	})
+
+	t.Run("Process_RetriesExhausted", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		processor := NewProcessor(mockRepo, WithOptimisticLocking(2))
+
+		newDoc := doc
+
+		conflict := &repository.VersionConflictError{Url: doc.Url}
+
+		mockRepo.On("SaveVersion", mock.Anything, &newDoc).Return(nil)
+		mockRepo.On("GetDocument", mock.Anything, doc.Url).Return(nil, repository.ErrDocumentNotFound)
+		mockRepo.On("SaveDocumentIfVersion", mock.Anything, mock.Anything, uint64(0)).Return(conflict)
+
+		result, err := processor.Process(context.Background(), &newDoc)
+		assert.ErrorIs(t, err, repository.ErrVersionConflict, "expected version conflict error")
+		assert.Nil(t, result, "expected nil result on exhausted retries")
+
+		mockRepo.AssertNumberOfCalls(t, "SaveDocumentIfVersion", 3)
+	})
+
+	t.Run("Process_Concurrent", func(t *testing.T) {
+		repo := repository.NewInMemoryRepository()
+		processor := NewProcessor(repo, WithOptimisticLocking(100))
+
+		gorutinesCount := 20
+
+		wg := sync.WaitGroup{}
+		wg.Add(gorutinesCount)
+
+		for idx := 1; idx <= gorutinesCount; idx++ {
+			go func(idx int) {
+				defer wg.Done()
+				_, err := processor.Process(context.Background(), &model.Document{
+					Url:       doc.Url,
+					PubDate:   uint64(idx),
+					FetchTime: uint64(idx),
+					Text:      fmt.Sprintf("content %d", idx),
+				})
+				assert.NoError(t, err, "expected no error processing document concurrently")
+			}(idx)
+		}
+
+		wg.Wait()
+
+		result, err := repo.GetDocument(context.Background(), doc.Url)
+		assert.NoError(t, err, "expected no error getting document")
+		assert.Equal(t, fmt.Sprintf("content %d", gorutinesCount), result.Text, "expected the latest text to win")
+		assert.Equal(t, uint64(1), result.PubDate, "expected the earliest pub date to win")
+		assert.Equal(t, model.Provenance{model.FieldText: uint64(gorutinesCount), model.FieldPubDate: 1}, result.Provenance, "expected the provenance of the winning fields")
+		assert.NotZero(t, result.Version, "expected the document to be saved")
+		assert.LessOrEqual(t, result.Version, uint64(gorutinesCount), "expected only merges that changed the document to bump the version")
+	})
+}
+
+func TestProcessor_WithMergeStrategy(t *testing.T) {
+	repo := repository.NewInMemoryRepository()
+	processor := NewProcessor(repo, WithMergeStrategy(NonEmptyTextMergeStrategy))
+
+	url := "http://example.com"
+
+	_, err := processor.Process(context.Background(), &model.Document{Url: url, FetchTime: 100, Text: "content"})
+	assert.NoError(t, err, "expected no error processing document")
+
+	result, err := processor.Process(context.Background(), &model.Document{Url: url, FetchTime: 200, Text: ""})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.Equal(t, "content", result.Document.Text, "expected the injected strategy to keep non-empty text")
+	assert.Equal(t, ChangeNone, result.Change, "expected the message to change nothing")
+
+	saved, err := repo.GetDocument(context.Background(), url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, uint64(200), saved.FetchTime, "expected the fetch time to be saved although the message changed no field")
+	assert.Equal(t, uint64(2), saved.Version)
+
+	_, err = processor.Process(context.Background(), &model.Document{Url: url, FetchTime: 200, Text: ""})
+	assert.NoError(t, err, "expected no error processing document")
+
+	saved, err = repo.GetDocument(context.Background(), url)
+	assert.NoError(t, err, "expected no error getting document")
+	assert.Equal(t, uint64(2), saved.Version, "expected a duplicate message not to save the document")
+}
+
+// A message that changes no field still moves fetch times and provenance,
+// an older message processed later must not win over it.
+func TestProcessor_OutOfOrderAfterNoop(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"Lock":       nil,
+		"Optimistic": {WithOptimisticLocking(3)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			repo := repository.NewInMemoryRepository()
+			processor := NewProcessor(repo, opts...)
+			url := "http://example.com"
+
+			for _, doc := range []*model.Document{
+				{Url: url, FetchTime: 100, PubDate: 10, Text: "A"},
+				{Url: url, FetchTime: 300, PubDate: 10, Text: "A"},
+				{Url: url, FetchTime: 200, PubDate: 20, Text: "B"},
+			} {
+				_, err := processor.Process(context.Background(), doc)
+				assert.NoError(t, err, "expected no error processing document")
+			}
+
+			saved, err := repo.GetDocument(context.Background(), url)
+			assert.NoError(t, err, "expected no error getting document")
+			assert.Equal(t, "A", saved.Text, "expected the text of the latest fetch")
+			assert.Equal(t, uint64(300), saved.FetchTime)
+			assert.Equal(t, uint64(10), saved.PubDate, "expected the pub date of the earliest fetch")
+			assert.Equal(t, uint64(100), saved.FirstFetchTime)
+			assert.Equal(t, model.Provenance{model.FieldText: 300, model.FieldPubDate: 100}, saved.Provenance)
+		})
+	}
+}
+
+func TestProcessor_ChangeReport(t *testing.T) {
+	repo := repository.NewInMemoryRepository()
+	processor := NewProcessor(repo)
+
+	url := "http://example.com"
+
+	tests := []struct {
+		name     string
+		doc      *model.Document
+		expected Change
+	}{
+		{"New", &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "content"}, ChangeNew},
+		{"Duplicate", &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "content"}, ChangeNone},
+		{"Stale", &model.Document{Url: url, PubDate: 10, FetchTime: 100, Text: "old content"}, ChangeNone},
+		{"UpdatedText", &model.Document{Url: url, PubDate: 20, FetchTime: 300, Text: "new content"}, ChangeText},
+		{"UpdatedPubDate", &model.Document{Url: url, PubDate: 5, FetchTime: 50, Text: "old content"}, ChangePubDate},
+	}
+
+	for _, tt := range tests {
+		result, err := processor.Process(context.Background(), tt.doc)
+		assert.NoError(t, err, "expected no error processing document")
+		assert.Equal(t, tt.expected, result.Change, "%s: expected the change report", tt.name)
+		assert.Equal(t, tt.expected != ChangeNone, result.Changed())
+	}
+}
+
+func TestProcessor_Diff(t *testing.T) {
+	repo := repository.NewInMemoryRepository()
+	processor := NewProcessor(repo)
+
+	url := "http://example.com"
+
+	result, err := processor.Process(context.Background(), &model.Document{Url: url, PubDate: 10, FetchTime: 200, Text: "first\nsecond\n"})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.True(t, result.Diff.New, "expected a new document")
+	assert.Len(t, result.Diff.Fields, 2, "expected every non-empty field of a new document")
+
+	result, err = processor.Process(context.Background(), &model.Document{Url: url, PubDate: 10, FetchTime: 300, Text: "first\nthird\n"})
+	assert.NoError(t, err, "expected no error processing document")
+
+	expected := &model.DocumentChange{
+		Url:       url,
+		FetchTime: 300,
+		Version:   2,
+		Fields:    []model.FieldChange{{Field: model.FieldText, OldValue: "first\nsecond\n", NewValue: "first\nthird\n"}},
+		TextDiff: "--- http://example.com (version 1)\n+++ http://example.com (version 2)\n" +
+			"@@ -1,2 +1,2 @@\n first\n-second\n+third\n",
+	}
+	assert.Equal(t, expected, result.Diff, "expected the text diff")
+
+	result, err = processor.Process(context.Background(), &model.Document{Url: url, PubDate: 5, FetchTime: 100, Text: "zero\n"})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.Equal(t, []model.FieldChange{{Field: model.FieldPubDate, OldValue: "10", NewValue: "5"}}, result.Diff.Fields)
+	assert.Empty(t, result.Diff.TextDiff, "expected no text diff")
+
+	result, err = processor.Process(context.Background(), &model.Document{Url: url, PubDate: 5, FetchTime: 100, Text: "zero\n"})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.Nil(t, result.Diff, "expected no diff for a no-op")
+}
+
+func TestProcessor_WithURLNormalizer(t *testing.T) {
+	repo := repository.NewInMemoryRepository()
+	processor := NewProcessor(repo, WithURLNormalizer(urlnorm.New()))
+
+	rawURL := "http://Example.com/a?utm_source=x#frag"
+
+	result, err := processor.Process(context.Background(), &model.Document{Url: rawURL, FetchTime: 100, Text: "first"})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.Equal(t, "http://example.com/a", result.Document.Url, "expected the normalized url")
+	assert.Equal(t, rawURL, result.Document.OriginalUrl, "expected the original url to be kept")
+
+	result, err = processor.Process(context.Background(), &model.Document{Url: "http://example.com/a", FetchTime: 200, Text: "second"})
+	assert.NoError(t, err, "expected no error processing document")
+	assert.Equal(t, ChangeText, result.Change, "expected both urls to update the same document")
+
+	versions, err := repo.ListVersions(context.Background(), "http://example.com/a")
+	assert.NoError(t, err, "expected no error listing versions")
+	assert.Len(t, versions, 2, "expected both messages to be stored as versions")
+	assert.Equal(t, rawURL, versions[0].OriginalUrl, "expected the version to keep the original url")
+}
+
+func TestProcessor_Redelivered(t *testing.T) {
+	mockRepo := new(MockRepository)
+	processor := NewProcessor(mockRepo)
+
+	existingDoc := &model.Document{Url: "http://example.com", PubDate: 10, FetchTime: 200, Text: "stored content", FirstFetchTime: 100, Version: 2}
+	storedDoc := existingDoc.Copy()
+	newDoc := &model.Document{Url: existingDoc.Url, PubDate: 10, FetchTime: 300, Text: "new content"}
+
+	mockLock := new(MockLock)
+	mockLock.On("Unlock", mock.Anything).Return(nil)
+	mockRepo.On("LockDocument", mock.Anything, newDoc.Url).Return(mockLock, nil)
+	mockRepo.On("GetDocument", mock.Anything, newDoc.Url).Return(existingDoc, nil)
+	mockRepo.On("SaveVersion", mock.Anything, newDoc).Return(nil)
+	mockRepo.On("SaveDocument", mock.Anything, mock.Anything).Return(repository.ErrMessageProcessed)
+
+	result, err := processor.Process(context.Background(), newDoc)
+	assert.NoError(t, err, "expected no error processing a redelivered message")
+	assert.Equal(t, ChangeRedelivered, result.Change, "expected the redelivery to be reported")
+	assert.Equal(t, storedDoc, result.Document, "expected the stored document")
+	assert.True(t, result.Changed(), "expected the stored document to be written again")
+	assert.Nil(t, result.Diff, "expected no diff for a redelivery")
+
+	mockRepo.AssertExpectations(t)
+	mockLock.AssertExpectations(t)
+}
@@ -0,0 +1,119 @@
+// Package urlnorm brings document URLs to a canonical form, so that the same
+// page fetched under different URLs is stored as one document.
+package urlnorm
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultTrackingParams are query parameters that do not change the page.
+// A trailing "*" matches any parameter with the prefix.
+var DefaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "yclid", "_openstat"}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+type Normalizer struct {
+	trackingParams []string
+	scheme         string
+}
+
+type Option func(*Normalizer)
+
+// WithTrackingParams replaces DefaultTrackingParams. Params are matched
+// case-insensitively, surrounding spaces and empty params are dropped.
+func WithTrackingParams(params ...string) Option {
+	return func(n *Normalizer) {
+		n.trackingParams = nil
+		for _, param := range params {
+			if param = strings.ToLower(strings.TrimSpace(param)); param != "" {
+				n.trackingParams = append(n.trackingParams, param)
+			}
+		}
+	}
+}
+
+// WithScheme rewrites http and https URLs to the given scheme.
+func WithScheme(scheme string) Option {
+	return func(n *Normalizer) {
+		n.scheme = strings.ToLower(scheme)
+	}
+}
+
+func New(opts ...Option) *Normalizer {
+	n := &Normalizer{trackingParams: DefaultTrackingParams}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// Normalize lowercases the host, strips the default port, the fragment and
+// tracking parameters and sorts the query by key.
+func (n *Normalizer) Normalize(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("can't normalize url: %w", err)
+	}
+
+	// the scheme is rewritten first, so that the default ports of both the
+	// original and the new scheme are stripped
+	scheme := u.Scheme
+	if n.scheme != "" {
+		if _, exists := defaultPorts[u.Scheme]; exists {
+			u.Scheme = n.scheme
+		}
+	}
+
+	if u.Host != "" {
+		host, port := strings.ToLower(u.Hostname()), u.Port()
+		if port == defaultPorts[scheme] || port == defaultPorts[u.Scheme] {
+			port = ""
+		}
+		if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		} else {
+			u.Host = host
+		}
+
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	query := u.Query()
+	for key := range query {
+		if n.isTracking(key) {
+			query.Del(key)
+		}
+	}
+	// Encode sorts by key
+	u.RawQuery = query.Encode()
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+func (n *Normalizer) isTracking(key string) bool {
+	key = strings.ToLower(key)
+	for _, param := range n.trackingParams {
+		if prefix, found := strings.CutSuffix(param, "*"); found {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == param {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package urlnorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		url      string
+		expected string
+	}{
+		{"Canonical", nil, "http://example.com/a?b=1", "http://example.com/a?b=1"},
+		{"Host", nil, "HTTP://Example.COM/Path", "http://example.com/Path"},
+		{"EmptyPath", nil, "http://example.com", "http://example.com/"},
+		{"DefaultPort", nil, "http://example.com:80/a", "http://example.com/a"},
+		{"DefaultHttpsPort", nil, "https://example.com:443/a", "https://example.com/a"},
+		{"OtherPort", nil, "http://example.com:8080/a", "http://example.com:8080/a"},
+		{"IPv6", nil, "http://[::1]:80/a", "http://[::1]/a"},
+		{"Fragment", nil, "http://example.com/a#frag", "http://example.com/a"},
+		{"TrackingParams", nil, "http://example.com/a?utm_source=x&id=1&fbclid=y&UTM_Medium=z", "http://example.com/a?id=1"},
+		{"OnlyTrackingParams", nil, "http://Example.com/a?utm_source=x#frag", "http://example.com/a"},
+		{"SortQuery", nil, "http://example.com/a?b=2&a=1&b=1", "http://example.com/a?a=1&b=2&b=1"},
+		{"CustomTrackingParams", []Option{WithTrackingParams("ref")}, "http://example.com/a?ref=x&utm_source=y", "http://example.com/a?utm_source=y"},
+		{"Scheme", []Option{WithScheme("https")}, "http://example.com:80/a", "https://example.com/a"},
+		{"SchemeDefaultPort", []Option{WithScheme("https")}, "http://example.com:443/a", "https://example.com/a"},
+		{"SchemeOtherPort", []Option{WithScheme("https")}, "http://example.com:8080/a", "https://example.com:8080/a"},
+		{"TrackingParamsSpacesAndCase", []Option{WithTrackingParams(" Ref ", "", "UTM_*")}, "http://example.com/a?ref=x&utm_source=y&id=1", "http://example.com/a?id=1"},
+		{"SchemeOtherProtocol", []Option{WithScheme("https")}, "ftp://example.com/a", "ftp://example.com/a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := New(tt.opts...).Normalize(tt.url)
+			assert.NoError(t, err, "expected no error normalizing url")
+			assert.Equal(t, tt.expected, url, "expected the canonical url")
+		})
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := New().Normalize("http://example.com/%zz")
+		assert.Error(t, err, "expected error normalizing invalid url")
+	})
+}
@@ -0,0 +1,99 @@
+// Package validator rejects documents that must not be stored.
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"vk/pkg/model"
+)
+
+var (
+	ErrEmptyURL        = errors.New("empty url")
+	ErrInvalidURL      = errors.New("invalid url")
+	ErrZeroFetchTime   = errors.New("zero fetch time")
+	ErrFutureFetchTime = errors.New("fetch time is in the future")
+	ErrTextTooLarge    = errors.New("text is too large")
+)
+
+// ValidationError is returned for a rejected document. It wraps the reason,
+// one of the Err* errors above.
+type ValidationError struct {
+	Url    string
+	Reason error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid document %q: %v", e.Url, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Reason
+}
+
+// Rule returns the reason to reject a document or nil.
+type Rule func(doc *model.Document) error
+
+// RequireURL rejects documents with an empty url or an url that is not absolute.
+func RequireURL(doc *model.Document) error {
+	if doc.Url == "" {
+		return ErrEmptyURL
+	}
+
+	u, err := url.Parse(doc.Url)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// RequireFetchTime rejects documents without FetchTime.
+func RequireFetchTime(doc *model.Document) error {
+	if doc.FetchTime == 0 {
+		return ErrZeroFetchTime
+	}
+	return nil
+}
+
+// MaxFetchTime rejects documents fetched later than now plus the allowed
+// clock skew. FetchTime is in unix seconds.
+func MaxFetchTime(now func() time.Time, skew time.Duration) Rule {
+	return func(doc *model.Document) error {
+		limit := now().Add(skew).Unix()
+		if limit >= 0 && doc.FetchTime > uint64(limit) {
+			return fmt.Errorf("%w: %d", ErrFutureFetchTime, doc.FetchTime)
+		}
+		return nil
+	}
+}
+
+// MaxTextSize rejects documents with Text longer than size bytes.
+func MaxTextSize(size int) Rule {
+	return func(doc *model.Document) error {
+		if len(doc.Text) > size {
+			return fmt.Errorf("%w: %d bytes", ErrTextTooLarge, len(doc.Text))
+		}
+		return nil
+	}
+}
+
+type Validator struct {
+	rules []Rule
+}
+
+func New(rules ...Rule) *Validator {
+	return &Validator{rules: rules}
+}
+
+// Validate checks the rules in order and returns a *ValidationError for the
+// first one the document breaks.
+func (v *Validator) Validate(doc *model.Document) error {
+	for _, rule := range v.rules {
+		if err := rule(doc); err != nil {
+			return &ValidationError{Url: doc.Url, Reason: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"vk/pkg/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidator(t *testing.T) {
+	now := time.Unix(1000, 0)
+	v := New(
+		RequireURL,
+		RequireFetchTime,
+		MaxFetchTime(func() time.Time { return now }, time.Minute),
+		MaxTextSize(10),
+	)
+
+	tests := []struct {
+		name     string
+		doc      *model.Document
+		expected error
+	}{
+		{"Valid", &model.Document{Url: "http://example.com", FetchTime: 1000, Text: "content"}, nil},
+		{"EmptyURL", &model.Document{FetchTime: 1000}, ErrEmptyURL},
+		{"RelativeURL", &model.Document{Url: "/path", FetchTime: 1000}, ErrInvalidURL},
+		{"MalformedURL", &model.Document{Url: "http://example.com/%zz", FetchTime: 1000}, ErrInvalidURL},
+		{"ZeroFetchTime", &model.Document{Url: "http://example.com"}, ErrZeroFetchTime},
+		{"ClockSkew", &model.Document{Url: "http://example.com", FetchTime: 1060}, nil},
+		{"FutureFetchTime", &model.Document{Url: "http://example.com", FetchTime: 1061}, ErrFutureFetchTime},
+		{"TextTooLarge", &model.Document{Url: "http://example.com", FetchTime: 1000, Text: strings.Repeat("a", 11)}, ErrTextTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Validate(tt.doc)
+			if tt.expected == nil {
+				assert.NoError(t, err, "expected the document to be valid")
+				return
+			}
+
+			assert.ErrorIs(t, err, tt.expected, "expected the rejection reason")
+
+			var validationErr *ValidationError
+			assert.ErrorAs(t, err, &validationErr, "expected a validation error")
+			assert.Equal(t, tt.doc.Url, validationErr.Url)
+		})
+	}
+
+	t.Run("NoRules", func(t *testing.T) {
+		assert.NoError(t, New().Validate(&model.Document{}), "expected no error without rules")
+	})
+}